@@ -4,18 +4,23 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"net"
 	"os"
 	"os/user"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"time"
 
 	br "github.com/aletheia7/banip/rbl"
 
+	"github.com/aletheia7/banip/ctl"
+	"github.com/aletheia7/banip/f2b"
 	"github.com/aletheia7/banip/filter"
 	"github.com/aletheia7/banip/server"
+	"github.com/aletheia7/banip/source"
 	"github.com/aletheia7/banip/syn"
 	"github.com/aletheia7/gogroup"
 	"github.com/aletheia7/mbus"
@@ -23,24 +28,41 @@ import (
 )
 
 var (
-	testdata = flag.String("testdata", "", "run path to toml, use testdata and exit")
-	test     = flag.String("test", "", "run path to toml, use journalctl and exit")
-	blip     = flag.String("blip", "", "blacklist IP and exit")
+	testdata = flag.String("testdata", "", "run testdata of toml paths or directories, comma separated, and exit. exit 1 on a mismatch")
+	td_json  = flag.Bool("json", false, "print the -testdata report as JSON")
+	explain  = flag.String("explain", "", "show the decision path of a log line through the toml filters and exit")
+	ex_tag   = flag.String("explain-tag", "", "syslog identifier of the -explain line, default: any")
+	lint     = flag.String("lint", "", "check the toml filters of a directory and exit. exit 1 on a problem")
+	builtins = flag.Bool("builtins", false, "list the built-in filters and exit")
+	dump_b   = flag.String("dump-builtin", "", "write a built-in filter to <toml dir>/<name>.toml for customization and exit")
+	test     = flag.String("test", "", "run path to toml, use journalctl or the filter source and exit")
+	blip     = flag.String("blip", "", "blacklist IP/CIDR and exit")
 	wlip     = flag.String("wlip", "", "whitelist IP/CIDR and exit")
 	rmip     = flag.String("rmip", "", "remove IP and exit")
 	qip      = flag.String("qip", "", "query IP and exit")
+	ls       = flag.Bool("list", false, "list blacklist and whitelist and exit")
+	stats    = flag.Bool("show-stats", false, "show daemon stats and exit")
 	since    = flag.String("since", "", "passed to journalctl --since")
 	rbl      = flag.String("rbl", "", "query rbls with IP and exit")
 	rbls_in  = flag.String("rbls", "dnsbl-1.uceprotect.net,dnsbl-2.uceprotect.net,dnsbl-3.uceprotect.net,sbl-xbl.spamhaus.org,bl.spamcop.net,dnsbl.sorbs.net", "rbls: comma separted, or set banip_rbls environment variable")
 	rbls     []string
 	nf_mode  = flag.Bool("nf", false, "mode, blocks IP by rbl")
 	syn_mode = flag.Bool("syn", false, "mode, blocks IP by sync-recv")
+	fw_drv   = flag.String("fw", "", "mode, firewall driver drops blacklisted IP: nft, ipset or file, w/o -nf: runs toml filters")
+	nft_mode = flag.Bool("nft", false, "mode, same as -fw nft")
+	blip_dur = flag.Duration("blip-bdur", 0, "ban duration w/ -blip, escalated by -bsteps, default: -bdur")
 	load_f2b = flag.String("load-f2b", "", "load <full path>/fail2ban.sqlite3 and exit")
+	conv_f2b = flag.String("convert-f2b", "", "convert the fail2ban filter.d and jails of a directory, i.e. /etc/fail2ban, to toml filters in -convert-out and exit")
+	conv_out = flag.String("convert-out", "", "toml directory of -convert-f2b")
+	conv_t   = flag.String("convert-tests", "", "fail2ban test logs of -convert-f2b, i.e. fail2ban/tests/files/logs, carried over as testdata")
+	recon    = flag.Bool("reconcile", false, "reconcile -fw driver with blacklist and exit")
 	ver      = flag.Bool("v", false, "version")
 	gver     = flag.Bool("gv", false, "go version")
 	j        = sd.New()
 	gg       = gogroup.New()
 	Gtag     string
+	// process exit code
+	exit int
 )
 
 func main() {
@@ -49,6 +71,9 @@ func main() {
 		*rbls_in = s
 	}
 	rbls = strings.Split(*rbls_in, ",")
+	if *nft_mode && len(*fw_drv) == 0 {
+		*fw_drv = `nft`
+	}
 	if *ver {
 		j.Option(sd.Set_default_disable_journal(true), sd.Set_default_writer_stdout())
 		j.Info(Gtag)
@@ -72,77 +97,237 @@ func main() {
 	case 0 < len(*wlip):
 		j.Option(sd.Set_default_disable_journal(true), sd.Set_default_writer_stdout())
 		j.Info("wlip:", *wlip)
-		server.New(gg, u.HomeDir, rbls).Wl(*wlip)
+		if !server.Call(u.HomeDir, &ctl.Request{Cmd: ctl.Wl, Ip: *wlip}) {
+			server.New(gg, u.HomeDir, rbls).Wl(*wlip)
+		}
 		gg.Cancel()
 		return
 	case 0 < len(*blip):
 		j.Option(sd.Set_default_disable_journal(true), sd.Set_default_writer_stdout())
 		j.Info("blip:", *blip)
-		server.New(gg, u.HomeDir, rbls).Bl(*blip, "blip", nil, nil, time.Now())
+		if !server.Call(u.HomeDir, &ctl.Request{Cmd: ctl.Bl, Ip: *blip, Dur: *blip_dur}) {
+			server.New(gg, u.HomeDir, rbls).Bl(*blip, "blip", nil, nil, nil, time.Now(), *blip_dur)
+		}
 		gg.Cancel()
 		return
 	case 0 < len(*rmip):
 		j.Option(sd.Set_default_disable_journal(true), sd.Set_default_writer_stdout())
 		j.Info("rmip:", *rmip)
-		server.New(gg, u.HomeDir, rbls).Rm(*rmip)
+		if !server.Call(u.HomeDir, &ctl.Request{Cmd: ctl.Rm, Ip: *rmip}) {
+			server.New(gg, u.HomeDir, rbls).Rm(*rmip)
+		}
 		gg.Cancel()
 		return
 	case 0 < len(*qip):
 		j.Option(sd.Set_default_disable_journal(true), sd.Set_default_writer_stdout())
 		j.Info("qip:", *qip)
-		server.New(gg, u.HomeDir, rbls).Q(*qip)
+		if !server.Call(u.HomeDir, &ctl.Request{Cmd: ctl.Q, Ip: *qip}) {
+			server.New(gg, u.HomeDir, rbls).Q(*qip)
+		}
+		gg.Cancel()
+		return
+	case *ls:
+		j.Option(sd.Set_default_disable_journal(true), sd.Set_default_writer_stdout())
+		if !server.Call(u.HomeDir, &ctl.Request{Cmd: ctl.List}) {
+			for _, s := range server.New(gg, u.HomeDir, rbls).List() {
+				j.Info(s)
+			}
+		}
+		gg.Cancel()
+		return
+	case *stats:
+		j.Option(sd.Set_default_disable_journal(true), sd.Set_default_writer_stdout())
+		if !server.Call(u.HomeDir, &ctl.Request{Cmd: ctl.Stats}) {
+			j.Info("no daemon")
+			for _, s := range server.New(gg, u.HomeDir, rbls).Stats() {
+				j.Info(s)
+			}
+		}
+		gg.Cancel()
+		return
+	case *recon:
+		j.Option(sd.Set_default_disable_journal(true), sd.Set_default_writer_stdout())
+		j.Info("reconcile")
+		// The daemon owns the driver, i.e. file.New truncates the deny list
+		if !server.Call(u.HomeDir, &ctl.Request{Cmd: ctl.Reconcile}) {
+			if err := server.New(gg, u.HomeDir, rbls).Reconcile(*fw_drv); err != nil {
+				j.Err(err)
+			}
+		}
 		gg.Cancel()
 		return
 	case 0 < len(*load_f2b):
 		j = sd.New(sd.Set_default_disable_journal(true), sd.Set_default_writer_stdout())
 		j.Info("load fail2ban")
 		go server.Load_fail2ban(gg, *load_f2b, u.HomeDir)
+	case 0 < len(*conv_f2b):
+		j.Option(sd.Set_default_disable_journal(true), sd.Set_default_writer_stdout())
+		j.Info("convert fail2ban:", *conv_f2b)
+		if len(*conv_out) == 0 {
+			j.Err("missing -convert-out")
+			exit = 1
+		} else if notes, err := f2b.Convert(*conv_f2b, *conv_out, *conv_t); err != nil {
+			j.Err(err)
+			exit = 1
+		} else {
+			for _, s := range notes {
+				j.Info(s)
+			}
+		}
+		gg.Cancel()
+	case *builtins:
+		j.Option(sd.Set_default_disable_journal(true), sd.Set_default_writer_stdout())
+		for _, s := range filter.Builtins() {
+			j.Info(s)
+		}
+		gg.Cancel()
+	case 0 < len(*dump_b):
+		j.Option(sd.Set_default_disable_journal(true), sd.Set_default_writer_stdout())
+		if err := dump_builtin(*dump_b, server.Toml_dir(u.HomeDir)); err != nil {
+			j.Err(err)
+			exit = 1
+		}
+		gg.Cancel()
 	case 0 < len(*test):
 		j.Option(sd.Set_default_disable_journal(true), sd.Set_default_writer_stdout())
 		j.Info("test:", *test)
 		bus := mbus.New_bus(gg, j)
 		if f, err := filter.New(gg, bus, *test, server.New(gg, u.HomeDir, rbls).WB(), rbls); err == nil {
-			go server.Journal(gg, bus, true, f.Tag, *since)
+			if f.Source == source.Journal {
+				go server.Journal(gg, bus, true, f.Journal_match(), *since, ``, nil)
+			} else {
+				go server.Test_source(gg, bus, f.Source)
+			}
 		} else {
 			j.Err(err)
 			gg.Cancel()
 			return
 		}
 	case 0 < len(*testdata):
-		j.Option(sd.Set_default_disable_journal(true), sd.Set_default_writer_stdout())
-		j.Info("testdata:", *testdata)
-		bus := mbus.New_bus(gg, j)
-		if f, err := filter.New(gg, bus, *testdata, server.New(gg, u.HomeDir, rbls).WB(), rbls); err == nil {
-			f.Testdata()
+		if *td_json {
+			j.Option(sd.Set_default_disable_journal(true), sd.Set_default_writer_stderr())
 		} else {
+			j.Option(sd.Set_default_disable_journal(true), sd.Set_default_writer_stdout())
+		}
+		j.Info("testdata:", *testdata)
+		if !run_testdata() {
+			exit = 1
+		}
+		gg.Cancel()
+	case 0 < len(*explain):
+		j.Option(sd.Set_default_disable_journal(true), sd.Set_default_writer_stdout())
+		for _, s := range server.New(gg, u.HomeDir, rbls).Explain(*ex_tag, *explain) {
+			j.Info(s)
+		}
+		gg.Cancel()
+	case 0 < len(*lint):
+		j.Option(sd.Set_default_disable_journal(true), sd.Set_default_writer_stdout())
+		j.Info("lint:", *lint)
+		tags, err := server.Journal_identifiers()
+		if err != nil {
+			j.Warning("syslog_identifier not checked:", err)
+		}
+		problems := filter.Lint(*lint, tags)
+		for _, p := range problems {
+			j.Info(p)
+		}
+		if 0 < len(problems) {
+			j.Infof("problems: %v\n", len(problems))
+			exit = 1
+		}
+		gg.Cancel()
+	default:
+		if !*syn_mode && !*nf_mode && len(*fw_drv) == 0 {
+			j.Err("choose a mode")
+			gg.Cancel()
+			break
+		}
+		srv = server.New(gg, u.HomeDir, rbls)
+		// Before Run: a second daemon must not replace the firewall of the first
+		if err := srv.Listen(); err != nil {
 			j.Err(err)
 			gg.Cancel()
-			return
+			break
 		}
-	default:
-		good := false
 		if *syn_mode {
-			good = true
-			if srv == nil {
-				srv = server.New(gg, u.HomeDir, rbls)
-			}
 			syn.New(gg, srv)
 		}
-		if *nf_mode {
-			good = true
-			if srv == nil {
-				srv = server.New(gg, u.HomeDir, rbls)
-			}
+		if *nf_mode || 0 < len(*fw_drv) {
 			j.Info("version:", Gtag)
-			srv.Run(*since, *nf_mode)
-		}
-		if !good {
-			j.Err("choose a mode")
-			gg.Cancel()
+			srv.Run(*since, *nf_mode, *fw_drv)
 		}
 	}
-	defer gg.Wait()
 	<-gg.Done()
+	gg.Wait()
+	os.Exit(exit)
+}
+
+// dump_builtin writes the built-in filter name to dir. An existing toml is
+// not replaced.
+func dump_builtin(name, dir string) error {
+	b, err := filter.Builtin(name)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	fn := filepath.Join(dir, name+`.toml`)
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	j.Info("wrote:", fn)
+	return nil
+}
+
+// run_testdata returns false on a mismatch or an error
+func run_testdata() bool {
+	a := []string{}
+	for _, p := range strings.Split(*testdata, ",") {
+		if fi, err := os.Stat(p); err == nil && fi.IsDir() {
+			m, _ := filepath.Glob(filepath.Join(p, "*.toml"))
+			for _, fn := range m {
+				if filepath.Base(fn) != filter.Vars_file {
+					a = append(a, fn)
+				}
+			}
+			continue
+		}
+		a = append(a, p)
+	}
+	ok := true
+	reports := make([]*filter.Report, 0, len(a))
+	for _, fn := range a {
+		f, err := filter.Load(fn)
+		if err != nil {
+			j.Err(err)
+			ok = false
+			reports = append(reports, &filter.Report{Toml: fn, Err: err.Error()})
+			continue
+		}
+		r := f.Testdata()
+		if 0 < r.Failed {
+			ok = false
+		}
+		reports = append(reports, r)
+	}
+	if *td_json {
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent(``, `  `)
+		if err := e.Encode(reports); err != nil {
+			j.Err(err)
+			return false
+		}
+	}
+	return ok
 }
 
 func do_rbl() {
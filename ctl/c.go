@@ -0,0 +1,119 @@
+// Copyright 2018 aletheia7. All rights reserved. Use of this source code is
+// governed by a BSD-2-Clause license that can be found in the LICENSE file.
+
+// Package ctl is the admin control API of a running banip, served over a unix
+// socket. One JSON Request and one JSON Response per connection.
+package ctl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/aletheia7/gogroup"
+)
+
+// Commands
+const (
+	Bl    = `bl`
+	Wl    = `wl`
+	Rm    = `rm`
+	Q     = `q`
+	List  = `list`
+	Stats = `stats`
+	// Reconcile the -fw driver of the daemon with the blacklist
+	Reconcile = `reconcile`
+)
+
+// Err_no_daemon is returned by Call when no daemon is listening: no socket or
+// a stale socket
+var Err_no_daemon = errors.New("no daemon")
+
+const timeout = time.Second * 30
+
+type Request struct {
+	Cmd string
+	Ip  string `json:",omitempty"`
+	// Ban duration w/ Bl, 0: default
+	Dur time.Duration `json:",omitempty"`
+}
+
+// Out is printed by the client line by line
+type Response struct {
+	Err string   `json:",omitempty"`
+	Out []string `json:",omitempty"`
+}
+
+type Handler func(*Request) *Response
+
+// Listen serves h on the socket path until gg is done. A stale socket is
+// removed, a socket with a listening daemon is an error.
+func Listen(gg *gogroup.Group, path string, h Handler) error {
+	if c, err := net.DialTimeout(`unix`, path, time.Second); err == nil {
+		c.Close()
+		return fmt.Errorf("ctl: daemon already listening: %v", path)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// The socket is made 0600, the umask is process wide
+	mask := syscall.Umask(0177)
+	l, err := net.Listen(`unix`, path)
+	syscall.Umask(mask)
+	if err != nil {
+		return err
+	}
+	go func() {
+		key := gg.Register()
+		defer gg.Unregister(key)
+		<-gg.Done()
+		l.Close()
+	}()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serve(c, h)
+		}
+	}()
+	return nil
+}
+
+func serve(c net.Conn, h Handler) {
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(timeout))
+	var r Request
+	if err := json.NewDecoder(c).Decode(&r); err != nil {
+		json.NewEncoder(c).Encode(&Response{Err: err.Error()})
+		return
+	}
+	json.NewEncoder(c).Encode(h(&r))
+}
+
+// Call sends r to the daemon at path. Err_no_daemon: no daemon is listening.
+// Other dial errors, i.e. EACCES, are returned.
+func Call(path string, r *Request) (*Response, error) {
+	c, err := net.DialTimeout(`unix`, path, time.Second)
+	if err != nil {
+		if errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, Err_no_daemon
+		}
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(timeout))
+	if err = json.NewEncoder(c).Encode(r); err != nil {
+		return nil, err
+	}
+	res := &Response{}
+	if err = json.NewDecoder(c).Decode(res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
@@ -0,0 +1,64 @@
+package ctl
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aletheia7/gogroup"
+)
+
+func Test_call(t *testing.T) {
+	gg := gogroup.New()
+	defer gg.Wait()
+	defer gg.Cancel()
+	p := filepath.Join(t.TempDir(), `banip.sock`)
+	if _, err := Call(p, &Request{Cmd: Stats}); err != Err_no_daemon {
+		t.Fatalf("Call w/o daemon: %v, expected: %v", err, Err_no_daemon)
+	}
+	// Stale socket
+	stale := filepath.Join(t.TempDir(), `stale.sock`)
+	l, err := net.ListenUnix(`unix`, &net.UnixAddr{Name: stale, Net: `unix`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.SetUnlinkOnClose(false)
+	l.Close()
+	if _, err := Call(stale, &Request{Cmd: Stats}); err != Err_no_daemon {
+		t.Fatalf("Call stale socket: %v, expected: %v", err, Err_no_daemon)
+	}
+	// Other errors are not Err_no_daemon
+	f := filepath.Join(t.TempDir(), `file`)
+	if err := os.WriteFile(f, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Call(filepath.Join(f, `banip.sock`), &Request{Cmd: Stats}); err == nil || err == Err_no_daemon {
+		t.Fatalf("Call ENOTDIR: %v", err)
+	}
+	h := func(r *Request) *Response {
+		if r.Cmd != Q {
+			return &Response{Err: "unknown command: " + r.Cmd}
+		}
+		return &Response{Out: []string{r.Ip}}
+	}
+	if err := Listen(gg, p, h); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(p); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("socket mode: %v %v", fi, err)
+	}
+	if err := Listen(gg, p, h); err == nil {
+		t.Fatal("second Listen: expected error")
+	}
+	res, err := Call(p, &Request{Cmd: Q, Ip: `192.0.2.1`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Out) != 1 || res.Out[0] != `192.0.2.1` {
+		t.Fatalf("Out: %v", res.Out)
+	}
+	if res, _ = Call(p, &Request{Cmd: `x`}); len(res.Err) == 0 {
+		t.Fatal("expected Err")
+	}
+}
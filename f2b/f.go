@@ -0,0 +1,775 @@
+// Copyright 2018 aletheia7. All rights reserved. Use of this source code is
+// governed by a BSD-2-Clause license that can be found in the LICENSE file.
+
+// Package f2b converts fail2ban filter.d and jail definitions to banip toml
+// filters.
+package f2b
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aletheia7/banip/filter"
+	"github.com/aletheia7/banip/list"
+)
+
+// Prefix replaces %(__prefix_line)s with a file source: the time, host and
+// tag of a syslog file line. A journal MESSAGE has no prefix.
+const Prefix = `(?:\w{3} +\d+ \d\d:\d\d:\d\d|\d{4}-\d\d-\d\d[T ]\S+) (?:\S+ )?[^\s\[:]+(?:\[\d+\])?: `
+
+var (
+	prefix_re  = regexp.MustCompile(`^` + Prefix)
+	interp_re  = regexp.MustCompile(`%\(([^)]+)\)s`)
+	tag_re     = regexp.MustCompile(`(^|[^P])<([a-z0-9_-]+)>`)
+	ftag_re    = regexp.MustCompile(`<(/?)F-([A-Za-z0-9_]+)>`)
+	unknown_re = regexp.MustCompile(`<[A-Z][A-Z0-9_-]*>`)
+	daemon_re  = regexp.MustCompile(`^[\w./@-]+$`)
+	time_re    = regexp.MustCompile(`^(?:\s*\d+\s*[a-z]*)+$`)
+	unit_re    = regexp.MustCompile(`(\d+)\s*([a-z]*)`)
+)
+
+// Ip tags of fail2ban
+var ip_tags = map[string]string{
+	`<HOST>`: `{{.Ip}}`,
+	`<ADDR>`: `{{.Ip}}`,
+	`<IP4>`:  `{{.Ipv4}}`,
+	`<IP6>`:  `{{.Ipv6}}`,
+}
+
+// Jail keys of the toml, mode is a filter option. Other keys of an enabled
+// jail are noted.
+var jail_keys = map[string]bool{
+	`enabled`:      true,
+	`filter`:       true,
+	`maxretry`:     true,
+	`findtime`:     true,
+	`bantime`:      true,
+	`backend`:      true,
+	`logpath`:      true,
+	`journalmatch`: true,
+	`ignoreip`:     true,
+	`mode`:         true,
+}
+
+// ini is a fail2ban config: section, key, value. A key set again keeps the
+// previous value as known/<key>.
+type ini map[string]map[string]string
+
+func (o ini) set(section, key, v string) {
+	m := o[section]
+	if m == nil {
+		m = map[string]string{}
+		o[section] = m
+	}
+	if old, ok := m[key]; ok {
+		m[`known/`+key] = old
+	}
+	m[key] = v
+}
+
+// read reads fn and its .local
+func (o ini) read(fn string, depth int) error {
+	if err := o.read_one(fn, depth); err != nil {
+		return err
+	}
+	if local := strings.TrimSuffix(fn, `.conf`) + `.local`; local != fn {
+		if err := o.read_one(local, depth); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// read_one reads the [INCLUDES] before, fn and the [INCLUDES] after. A
+// missing include is skipped.
+func (o ini) read_one(fn string, depth int) error {
+	if 8 < depth {
+		return fmt.Errorf("%v: include depth", fn)
+	}
+	f, err := parse(fn)
+	if err != nil {
+		return err
+	}
+	inc := f[`INCLUDES`]
+	delete(f, `INCLUDES`)
+	for _, s := range strings.Fields(inc[`before`]) {
+		if err := o.read(filepath.Join(filepath.Dir(fn), s), depth+1); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for section, m := range f {
+		for k, v := range m {
+			o.set(section, k, v)
+		}
+	}
+	for _, s := range strings.Fields(inc[`after`]) {
+		if err := o.read(filepath.Join(filepath.Dir(fn), s), depth+1); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// parse reads one ini file. Keys are lower case, a continuation line starts
+// with white space.
+func parse(fn string) (ini, error) {
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	r := ini{}
+	var section, key string
+	for i, l := range strings.Split(string(b), "\n") {
+		t := strings.TrimSpace(l)
+		switch {
+		case len(t) == 0 || t[0] == '#' || t[0] == ';':
+		case 0 < len(key) && (l[0] == ' ' || l[0] == '\t'):
+			r[section][key] += "\n" + t
+		case t[0] == '[' && t[len(t)-1] == ']':
+			section, key = t[1:len(t)-1], ``
+			if r[section] == nil {
+				r[section] = map[string]string{}
+			}
+		default:
+			k := strings.IndexAny(t, `=:`)
+			if k < 1 || len(section) == 0 {
+				return nil, fmt.Errorf("%v:%v: not a key = value: %v", fn, i+1, t)
+			}
+			key = strings.ToLower(strings.TrimSpace(t[:k]))
+			r[section][key] = strings.TrimSpace(t[k+1:])
+		}
+	}
+	return r, nil
+}
+
+// scope resolves keys in over, then the sections in order
+type scope struct {
+	c    ini
+	name string
+	secs []string
+	over map[string]string
+	// <key> is replaced as well
+	tags bool
+}
+
+func (o *scope) lookup(k string) (string, bool) {
+	if v, ok := o.over[k]; ok {
+		return v, true
+	}
+	if k == `__name__` {
+		return o.name, true
+	}
+	for _, s := range o.secs {
+		if v, ok := o.c[s][k]; ok {
+			return v, true
+		}
+	}
+	return ``, false
+}
+
+// get returns the value of k interpolated
+func (o *scope) get(k string) string {
+	v, _ := o.lookup(k)
+	return o.expand(v)
+}
+
+// expand replaces %(key)s and with tags <key>. Unknown keys are kept.
+func (o *scope) expand(v string) string {
+	for i := 0; i < 32; i++ {
+		n := interp_re.ReplaceAllStringFunc(v, func(m string) string {
+			if r, ok := o.lookup(strings.ToLower(m[2 : len(m)-2])); ok {
+				return r
+			}
+			return m
+		})
+		if o.tags {
+			n = tag_re.ReplaceAllStringFunc(n, func(m string) string {
+				sm := tag_re.FindStringSubmatch(m)
+				if r, ok := o.lookup(sm[2]); ok {
+					return sm[1] + r
+				}
+				return m
+			})
+		}
+		if n == v {
+			break
+		}
+		v = n
+	}
+	return strings.ReplaceAll(v, `%%`, `%`)
+}
+
+// Toml is a converted filter
+type Toml struct {
+	Name, From string
+	Enabled    bool
+	Tag        []string
+	// journalctl matches: FIELD=value
+	Journal           []string
+	Source            string
+	Maxretry          int64
+	Findtime, Bantime time.Duration
+	Re, Ignore        []string
+	Ignore_ip         []string
+	Testdata          []filter.Testdata
+}
+
+type converter struct {
+	dir, tests string
+	notes      []string
+}
+
+func (o *converter) note(name, format string, a ...interface{}) {
+	o.notes = append(o.notes, name+`: `+fmt.Sprintf(format, a...))
+}
+
+// Convert reads dir (i.e. /etc/fail2ban) filter.d/*.conf and jail.conf,
+// jail.d/*.conf, jail.local, jail.d/*.local and writes a toml to out for each
+// enabled jail and each filter without an enabled jail (disabled). A filter
+// named like a jail is written to <name>-filter.toml. tests: the fail2ban test
+// logs (fail2ban/tests/files/logs), empty: none. notes are the constructs not
+// translated and the -lint problems of out.
+func Convert(dir, out, tests string) (notes []string, err error) {
+	o := &converter{dir: dir, tests: tests}
+	jails := ini{}
+	for _, p := range []string{`jail.conf`, `jail.d/*.conf`, `jail.local`, `jail.d/*.local`} {
+		a, _ := filepath.Glob(filepath.Join(dir, p))
+		sort.Strings(a)
+		for _, fn := range a {
+			if err := jails.read_one(fn, 0); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err = os.MkdirAll(out, 0755); err != nil {
+		return nil, err
+	}
+	used := map[string]bool{}
+	// toml file name: jail or filter name
+	written := map[string]string{}
+	names := make([]string, 0, len(jails))
+	for name := range jails {
+		if name != `DEFAULT` {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		t, fname := o.jail(jails, name)
+		if t == nil {
+			continue
+		}
+		used[fname] = true
+		fn := file_name(name) + `.toml`
+		if w, ok := written[fn]; ok {
+			return nil, fmt.Errorf("jails %v and %v: same toml: %v", w, name, fn)
+		}
+		written[fn] = name
+		if err = t.write(filepath.Join(out, fn)); err != nil {
+			return nil, err
+		}
+	}
+	a, _ := filepath.Glob(filepath.Join(dir, `filter.d`, `*.conf`))
+	sort.Strings(a)
+	for _, fn := range a {
+		name := strings.TrimSuffix(filepath.Base(fn), `.conf`)
+		if used[name] {
+			continue
+		}
+		t := o.filter(name, nil, false)
+		if t == nil {
+			continue
+		}
+		fn := file_name(name) + `.toml`
+		if w, ok := written[fn]; ok {
+			fn = file_name(name) + `-filter.toml`
+			if w2, ok := written[fn]; ok {
+				return nil, fmt.Errorf("filter %v: %v and %v: same toml", name, w, w2)
+			}
+			o.note(name, "jail %v has the same name, wrote: %v", w, fn)
+		}
+		written[fn] = name
+		if err = t.write(filepath.Join(out, fn)); err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range filter.Lint(out, nil) {
+		if len(tests) == 0 && p.Msg == `no testdata` {
+			continue
+		}
+		o.notes = append(o.notes, `lint: `+p.String())
+	}
+	return o.notes, nil
+}
+
+// jail returns the toml of an enabled jail and its filter name. nil: disabled.
+func (o *converter) jail(c ini, name string) (*Toml, string) {
+	s := &scope{c: c, name: name, secs: []string{name, `DEFAULT`}}
+	if !is_true(s.get(`enabled`)) {
+		return nil, ``
+	}
+	spec := s.get(`filter`)
+	fname, args := spec, map[string]string{}
+	if i := strings.IndexByte(spec, '['); 0 < i && strings.HasSuffix(spec, `]`) {
+		fname = spec[:i]
+		for _, kv := range strings.Split(spec[i+1:len(spec)-1], `,`) {
+			if k := strings.IndexByte(kv, '='); 0 < k {
+				args[strings.TrimSpace(kv[:k])] = strings.Trim(strings.TrimSpace(kv[k+1:]), `"'`)
+			}
+		}
+	}
+	fname = strings.TrimSpace(fname)
+	if len(fname) == 0 {
+		o.note(name, "no filter")
+		return nil, ``
+	}
+	other := []string{}
+	for k := range c[name] {
+		if !jail_keys[k] && !strings.HasPrefix(k, `known/`) {
+			other = append(other, k)
+		}
+	}
+	if 0 < len(other) {
+		sort.Strings(other)
+		o.note(name, "not translated: %v", strings.Join(other, `, `))
+	}
+	journal := strings.Contains(s.get(`backend`), `systemd`)
+	var source string
+	if !journal {
+		paths := strings.Fields(s.get(`logpath`))
+		switch {
+		case len(paths) == 1 && !strings.ContainsAny(paths[0], `*?[`):
+			source = `file:` + paths[0]
+		default:
+			o.note(name, "logpath %v: one file is supported, using the journal", paths)
+			journal = true
+		}
+	}
+	t := o.filter(fname, args, !journal)
+	if t == nil {
+		return nil, fname
+	}
+	t.Name, t.From, t.Enabled = name, `jail `+name+`, filter.d/`+fname+`.conf`, 0 < len(t.Re)
+	if !journal {
+		t.Source, t.Tag, t.Journal = source, nil, nil
+	}
+	if jm := s.get(`journalmatch`); journal && 0 < len(jm) {
+		t.Journal = o.journal(name, jm)
+	}
+	if v := s.get(`maxretry`); 0 < len(v) {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && 0 < n {
+			t.Maxretry = n
+		} else {
+			o.note(name, "maxretry: %v", v)
+		}
+	}
+	for _, d := range []struct {
+		key string
+		to  *time.Duration
+	}{{`findtime`, &t.Findtime}, {`bantime`, &t.Bantime}} {
+		v := s.get(d.key)
+		if len(v) == 0 {
+			continue
+		}
+		if dur, err := duration(v); err == nil {
+			*d.to = dur
+		} else {
+			o.note(name, "%v: %v", d.key, err)
+		}
+	}
+	for _, ip := range strings.Fields(s.get(`ignoreip`)) {
+		if _, err := list.Valid_ip_cidr(ip); err == nil {
+			t.Ignore_ip = append(t.Ignore_ip, ip)
+		} else {
+			o.note(name, "ignoreip %v: not an IP or CIDR", ip)
+		}
+	}
+	return t, fname
+}
+
+// filter converts filter.d/<name>.conf. args: the jail filter options, file:
+// a file source, the syslog prefix is in the line.
+func (o *converter) filter(name string, args map[string]string, file bool) *Toml {
+	c := ini{}
+	if err := c.read(filepath.Join(o.dir, `filter.d`, name+`.conf`), 0); err != nil {
+		o.note(name, "%v", err)
+		return nil
+	}
+	over := map[string]string{`__prefix_line`: ``}
+	if file {
+		over[`__prefix_line`] = Prefix
+	}
+	for k, v := range args {
+		over[k] = v
+	}
+	s := &scope{c: c, name: name, secs: []string{`Init`, `Definition`, `DEFAULT`}, over: over, tags: true}
+	failregex := lines(s.get(`failregex`))
+	if len(failregex) == 0 {
+		// i.e. common.conf
+		if args != nil {
+			o.note(name, "no failregex")
+		}
+		return nil
+	}
+	t := &Toml{Name: name, From: `filter.d/` + name + `.conf`}
+	if jm := s.get(`journalmatch`); !file && 0 < len(jm) {
+		t.Journal = o.journal(name, jm)
+	}
+	if d := s.get(`_daemon`); daemon_re.MatchString(d) {
+		t.Tag = []string{d}
+	} else if !file && len(t.Journal) == 0 {
+		o.note(name, "no syslog_identifier, _daemon: %q", d)
+	}
+	if v := s.get(`maxlines`); 0 < len(v) && v != `1` {
+		o.note(name, "maxlines %v: one line is matched", v)
+	}
+	// failregex and ignoreregex match the <F-CONTENT> of prefregex
+	pref := s.get(`prefregex`)
+	i, k := strings.Index(pref, `<F-CONTENT>`), strings.Index(pref, `</F-CONTENT>`)
+	if 0 < len(pref) && (i < 0 || k < i) {
+		o.note(name, "prefregex without <F-CONTENT>: %v", pref)
+		pref = ``
+	}
+	content := func(re string) string {
+		if len(pref) == 0 {
+			return re
+		}
+		return pref[:i] + `(?:` + strings.TrimPrefix(re, `^`) + `)` + pref[k+len(`</F-CONTENT>`):]
+	}
+	for _, fr := range failregex {
+		re, why := translate(content(fr), true)
+		if 0 < len(why) {
+			o.note(name, "failregex %v: %v", fr, why)
+			continue
+		}
+		t.Re = append(t.Re, re)
+	}
+	for _, ir := range lines(s.get(`ignoreregex`)) {
+		re, why := translate(content(ir), false)
+		if len(why) == 0 {
+			ex, err := filter.Expand(re, filter.Vars)
+			if err == nil {
+				t.Ignore = append(t.Ignore, ex)
+				continue
+			}
+			why = err.Error()
+		}
+		o.note(name, "ignoreregex %v: %v", ir, why)
+	}
+	if len(t.Re) == 0 {
+		o.note(name, "no failregex translated, disabled")
+	}
+	if 0 < len(o.tests) {
+		t.Testdata = o.testdata(name, !file)
+	}
+	return t
+}
+
+// journal returns the journalctl matches of a journalmatch. Groups after +
+// are dropped.
+func (o *converter) journal(name, jm string) []string {
+	groups := strings.Split(jm, `+`)
+	if 1 < len(groups) {
+		o.note(name, "journalmatch %v: the first group is used", jm)
+	}
+	r := []string{}
+	for _, m := range strings.Fields(groups[0]) {
+		if i := strings.IndexByte(m, '='); 0 < i {
+			r = append(r, m)
+		} else {
+			o.note(name, "journalmatch %v: not FIELD=value", m)
+		}
+	}
+	return r
+}
+
+// testdata returns the lines of the fail2ban test log of name. A line after
+// # failJSON: { "match": true, "host": "..." } is a failure of host, strip:
+// the syslog prefix is removed.
+func (o *converter) testdata(name string, strip bool) (r []filter.Testdata) {
+	b, err := os.ReadFile(filepath.Join(o.tests, name))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			o.note(name, "%v", err)
+		}
+		return
+	}
+	var expect *struct {
+		Match      bool
+		Host       string
+		Constraint string
+	}
+	for _, l := range strings.Split(string(b), "\n") {
+		switch {
+		case strings.HasPrefix(l, `# failJSON:`):
+			expect = nil
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(l, `# failJSON:`)), &expect); err != nil {
+				o.note(name, "testdata: %v: %v", err, l)
+			}
+		case strings.HasPrefix(l, `# filterOptions:`):
+			if 0 < len(r) {
+				o.note(name, "testdata: the lines after %v are not used", strings.TrimSpace(l))
+				return
+			}
+		case strings.HasPrefix(l, `#`) || len(strings.TrimSpace(l)) == 0:
+		case expect != nil:
+			if 0 == len(expect.Constraint) {
+				if strip {
+					l = prefix_re.ReplaceAllString(l, ``)
+				}
+				t := filter.Testdata{Line: l}
+				if expect.Match {
+					t.Verdict = filter.Matched
+					if net.ParseIP(expect.Host) != nil {
+						t.Ip = expect.Host
+					}
+				}
+				r = append(r, t)
+			}
+			expect = nil
+		}
+	}
+	return
+}
+
+// translate returns a fail2ban regex as a banip re template. why: not
+// translated. ip: the regex needs an IP tag.
+func translate(re string, ip bool) (string, string) {
+	switch {
+	case strings.Contains(re, `<SKIPLINES>`):
+		return ``, `<SKIPLINES> is multi-line`
+	case strings.Contains(re, `<F-NOFAIL>`):
+		return ``, `<F-NOFAIL> is not a failure`
+	case strings.Contains(re, `{{`):
+		return ``, `{{ is a banip template`
+	}
+	for _, s := range []string{`(?=`, `(?!`, `(?<=`, `(?<!`, `(?P=`, `(?#`} {
+		if strings.Contains(re, s) {
+			return ``, s + ` is not supported by Go regexp`
+		}
+	}
+	re = ftag_re.ReplaceAllStringFunc(re, func(m string) string {
+		sm := ftag_re.FindStringSubmatch(m)
+		switch {
+		case sm[1] == `/`:
+			return `)`
+		case sm[2] == `MLFID`, sm[2] == `MLFFORGET`, sm[2] == `MLFGAINED`, sm[2] == `CONTENT`:
+			return `(?:`
+		}
+		return `(?P<` + strings.ToLower(sm[2]) + `>`
+	})
+	// An empty <F-MLFID> of %(__prefix_line)s
+	re = strings.ReplaceAll(re, `(?:)`, ``)
+	has_ip := false
+	for tag, v := range ip_tags {
+		if strings.Contains(re, tag) {
+			has_ip = true
+			re = strings.ReplaceAll(re, tag, v)
+		}
+	}
+	if m := unknown_re.FindString(re); 0 < len(m) {
+		return ``, m + ` is not translated`
+	}
+	if ip && !has_ip {
+		return ``, `no <HOST> or <ADDR>`
+	}
+	re = strings.ReplaceAll(re, `\Z`, `\z`)
+	ex, err := filter.Expand(re, filter.Vars)
+	if err != nil {
+		return ``, err.Error()
+	}
+	if _, err = regexp.Compile(ex); err != nil {
+		return ``, err.Error()
+	}
+	return re, ``
+}
+
+// duration parses a fail2ban time: seconds or i.e. 10m, 1h 30m, 1d, 1w
+func duration(s string) (time.Duration, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if n <= 0 {
+			return 0, fmt.Errorf("%v: permanent or none, use -bsteps", s)
+		}
+		return time.Duration(n) * time.Second, nil
+	}
+	if !time_re.MatchString(s) {
+		return 0, fmt.Errorf("unknown time: %v", s)
+	}
+	var r time.Duration
+	for _, m := range unit_re.FindAllStringSubmatch(s, -1) {
+		n, _ := strconv.ParseInt(m[1], 10, 64)
+		var u time.Duration
+		switch m[2] {
+		case ``, `s`, `sec`, `secs`, `second`, `seconds`:
+			u = time.Second
+		case `m`, `min`, `mins`, `minute`, `minutes`:
+			u = time.Minute
+		case `h`, `hour`, `hours`:
+			u = time.Hour
+		case `d`, `day`, `days`:
+			u = time.Hour * 24
+		case `w`, `week`, `weeks`:
+			u = time.Hour * 24 * 7
+		case `mo`, `month`, `months`:
+			u = time.Hour * 730
+		case `y`, `year`, `years`:
+			u = time.Hour * 8760
+		default:
+			return 0, fmt.Errorf("unknown time unit: %v", s)
+		}
+		r += time.Duration(n) * u
+	}
+	return r, nil
+}
+
+func (o *Toml) write(fn string) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# fail2ban %v\n", o.From)
+	fmt.Fprintf(&b, "enabled = %v\n", o.Enabled)
+	if 0 < len(o.Tag) {
+		fmt.Fprintf(&b, "syslog_identifier = %v\n", array(o.Tag))
+	}
+	if 0 < len(o.Journal) {
+		fields := []string{}
+		values := map[string][]string{}
+		for _, m := range o.Journal {
+			i := strings.IndexByte(m, '=')
+			if _, ok := values[m[:i]]; !ok {
+				fields = append(fields, m[:i])
+			}
+			values[m[:i]] = append(values[m[:i]], m[i+1:])
+		}
+		a := make([]string, 0, len(fields))
+		for _, f := range fields {
+			if len(values[f]) == 1 {
+				a = append(a, f+` = `+quote(values[f][0]))
+			} else {
+				a = append(a, f+` = `+array(values[f]))
+			}
+		}
+		fmt.Fprintf(&b, "journal = { %v }\n", strings.Join(a, `, `))
+	}
+	if 0 < len(o.Source) {
+		fmt.Fprintf(&b, "source = %v\n", quote(o.Source))
+	}
+	if 0 < o.Maxretry {
+		fmt.Fprintf(&b, "maxretry = %v\n", o.Maxretry)
+	}
+	if 0 < o.Findtime {
+		fmt.Fprintf(&b, "findtime = '%v'\n", o.Findtime)
+	}
+	if 0 < o.Bantime {
+		fmt.Fprintf(&b, "ban_duration = '%v'\n", o.Bantime)
+	}
+	if 0 < len(o.Ignore_ip) {
+		fmt.Fprintf(&b, "ignore_ip = %v\n", array(o.Ignore_ip))
+	}
+	list_of(&b, `re`, o.Re)
+	list_of(&b, `ignore`, o.Ignore)
+	td := make([]string, 0, len(o.Testdata))
+	for _, t := range o.Testdata {
+		if len(t.Verdict) == 0 {
+			td = append(td, quote(t.Line))
+			continue
+		}
+		s := `{ line = ` + quote(t.Line) + `, expect = ` + quote(t.Verdict)
+		if 0 < len(t.Ip) {
+			s += `, ip = ` + quote(t.Ip)
+		}
+		td = append(td, s+` }`)
+	}
+	if 0 < len(td) {
+		b.WriteString("testdata = [\n")
+		for i, s := range td {
+			if i == 0 {
+				fmt.Fprintf(&b, "    %v\n", s)
+			} else {
+				fmt.Fprintf(&b, "  , %v\n", s)
+			}
+		}
+		b.WriteString("]\n")
+	}
+	return os.WriteFile(fn, b.Bytes(), 0644)
+}
+
+// list_of writes a toml array of k, one element per line
+func list_of(b *bytes.Buffer, k string, a []string) {
+	if len(a) == 0 {
+		return
+	}
+	fmt.Fprintf(b, "%v = [\n", k)
+	for i, s := range a {
+		if i == 0 {
+			fmt.Fprintf(b, "    %v\n", quote(s))
+		} else {
+			fmt.Fprintf(b, "  , %v\n", quote(s))
+		}
+	}
+	b.WriteString("]\n")
+}
+
+func array(a []string) string {
+	q := make([]string, 0, len(a))
+	for _, s := range a {
+		q = append(q, quote(s))
+	}
+	return `[` + strings.Join(q, `, `) + `]`
+}
+
+// quote returns a toml literal string, else a basic string
+func quote(s string) string {
+	switch {
+	case !strings.ContainsAny(s, "'\n\r"):
+		return `'` + s + `'`
+	case !strings.Contains(s, `'''`) && !strings.HasSuffix(s, `'`) && !strings.ContainsAny(s, "\n\r"):
+		return `'''` + s + `'''`
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '\\' || r == '"':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&b, `\u%04X`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// lines returns the non-empty lines of a multi-line value
+func lines(v string) (r []string) {
+	for _, l := range strings.Split(v, "\n") {
+		if l = strings.TrimSpace(l); 0 < len(l) {
+			r = append(r, l)
+		}
+	}
+	return
+}
+
+func is_true(s string) bool {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case `true`, `yes`, `on`, `1`:
+		return true
+	}
+	return false
+}
+
+// file_name returns a jail or filter name usable as a toml file name
+func file_name(s string) string {
+	return strings.NewReplacer(`/`, `-`, ` `, `-`).Replace(s)
+}
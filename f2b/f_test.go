@@ -0,0 +1,199 @@
+package f2b
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aletheia7/banip/filter"
+)
+
+var fixture = map[string]string{
+	`filter.d/common.conf`: `[INCLUDES]
+after = common.local
+
+[DEFAULT]
+__prefix_line = \s*(?:\S+\s+)?\S+\[\d+\]:\s+
+`,
+	`filter.d/sshd.conf`: `[INCLUDES]
+before = common.conf
+
+[DEFAULT]
+_daemon = sshd
+__suff = (?: port \d+)?(?: \[preauth\])?\s*
+
+[Definition]
+prefregex = ^<F-MLFID>%(__prefix_line)s</F-MLFID><F-CONTENT>.+</F-CONTENT>$
+
+cmnfailre = ^[aA]uthentication (?:failure|error|failed) for <F-USER>.*</F-USER> from <HOST>%(__suff)s$
+            ^Invalid user <F-USER>\S+</F-USER> from <HOST>%(__suff)s$
+mdre-normal =
+mdre-aggressive = ^Did not receive identification string from <HOST>%(__suff)s$
+
+mode = normal
+failregex = %(cmnfailre)s
+            <mdre-<mode>>
+            ^Failed password for (?!root) from <HOST>
+            ^<F-NOFAIL>Accepted \w+</F-NOFAIL> for <F-USER>\S+</F-USER> from <HOST>
+ignoreregex = ^Connection closed by <HOST> port \d+ \[preauth\]$
+journalmatch = _SYSTEMD_UNIT=sshd.service + _COMM=sshd
+`,
+	`jail.conf`: `[DEFAULT]
+ignoreip = 127.0.0.1/8 ::1
+bantime = 10m
+findtime = 600
+maxretry = 5
+backend = auto
+mode = normal
+filter = %(__name__)s[mode=%(mode)s]
+port = 0:65535
+enabled = false
+
+[sshd]
+port = ssh
+logpath = /var/log/auth.log
+`,
+	`jail.d/defaults.local`: `[sshd]
+enabled = true
+mode = aggressive
+backend = systemd
+maxretry = 3
+bantime = 1h 30m
+`,
+	`tests/sshd`: `# failJSON: { "time": "2005-06-21T16:47:48", "match": true, "host": "192.0.2.1" }
+Jun 21 16:47:48 host sshd[1234]: Authentication failure for root from 192.0.2.1 port 22
+# failJSON: { "match": true, "host": "192.0.2.4" }
+2005-06-21T16:47:48.123 host sshd[1234]: Invalid user bob from 192.0.2.4 port 22 [preauth]
+# failJSON: { "match": false }
+Jun 21 16:47:49 host sshd[1234]: Accepted publickey for root from 192.0.2.1
+# failJSON: { "match": true, "host": "192.0.2.2" }
+Jun 21 16:47:50 host sshd[1234]: Did not receive identification string from 192.0.2.2
+# filterOptions: [{"mode": "ddos"}]
+# failJSON: { "match": true, "host": "192.0.2.3" }
+Jun 21 16:47:51 host sshd[1234]: ddos from 192.0.2.3
+`,
+}
+
+// fixture_dir writes fixture and extra to a temp dir
+func fixture_dir(t *testing.T, extra map[string]string) string {
+	dir := t.TempDir()
+	for _, m := range []map[string]string{fixture, extra} {
+		for fn, s := range m {
+			fn = filepath.Join(dir, fn)
+			if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(fn, []byte(s), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return dir
+}
+
+func Test_convert(t *testing.T) {
+	dir := fixture_dir(t, nil)
+	out := filepath.Join(dir, `toml`)
+	notes, err := Convert(dir, out, filepath.Join(dir, `tests`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{`(?!`, `<F-NOFAIL>`, `journalmatch`, `not translated: port`, `filterOptions`} {
+		found := false
+		for _, s := range notes {
+			found = found || strings.Contains(s, expect)
+		}
+		if !found {
+			t.Error("missing note:", expect)
+		}
+	}
+	for _, s := range notes {
+		if strings.HasPrefix(s, `lint:`) {
+			t.Error(s)
+		}
+	}
+	f, err := filter.Load(filepath.Join(out, `sshd.toml`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Enabled || len(f.Rule) != 3 || len(f.Ignore) != 1 || f.Maxretry != 3 || f.Ban_duration != time.Minute*90 || f.Findtime != time.Minute*10 {
+		t.Errorf("%+v", f)
+	}
+	if strings.Join(f.Tag, ``) != `sshd` || strings.Join(f.Journal[`_SYSTEMD_UNIT`], ``) != `sshd.service` {
+		t.Error(f.Tag, f.Journal)
+	}
+	if r := f.Testdata(); r.Total != 4 || r.Failed != 0 {
+		t.Errorf("%+v", r)
+	}
+}
+
+// A jail and an unused filter with the same name
+func Test_collision(t *testing.T) {
+	dir := fixture_dir(t, map[string]string{
+		`jail.d/extra.local`: `[ssh-extra]
+enabled = true
+filter = sshd
+`,
+		`filter.d/ssh-extra.conf`: `[Definition]
+failregex = ^extra from <HOST>$
+`,
+	})
+	out := filepath.Join(dir, `toml`)
+	notes, err := Convert(dir, out, ``)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, s := range notes {
+		found = found || strings.Contains(s, `ssh-extra-filter.toml`)
+	}
+	if !found {
+		t.Error("missing note:", notes)
+	}
+	f, err := filter.Load(filepath.Join(out, `ssh-extra.toml`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Enabled || strings.Join(f.Tag, ``) != `sshd` {
+		t.Errorf("jail: %+v", f)
+	}
+	if f, err = filter.Load(filepath.Join(out, `ssh-extra-filter.toml`)); err != nil {
+		t.Fatal(err)
+	}
+	if f.Enabled || len(f.Rule) != 1 {
+		t.Errorf("filter: %+v", f)
+	}
+	// Jails with the same file name
+	dir = fixture_dir(t, map[string]string{
+		`jail.d/extra.local`: `[ssh extra]
+enabled = true
+filter = sshd
+
+[ssh-extra]
+enabled = true
+filter = sshd
+`,
+	})
+	if _, err = Convert(dir, filepath.Join(dir, `toml`), ``); err == nil {
+		t.Error("expected jail collision")
+	}
+}
+
+func Test_duration(t *testing.T) {
+	for s, expect := range map[string]time.Duration{
+		`600`:    time.Minute * 10,
+		`10m`:    time.Minute * 10,
+		`1h 30m`: time.Minute * 90,
+		`1d`:     time.Hour * 24,
+		`2w`:     time.Hour * 24 * 14,
+		`-1`:     0,
+		`1x`:     0,
+	} {
+		d, err := duration(s)
+		if d != expect || (expect == 0) != (err != nil) {
+			t.Error(s, d, err)
+		}
+	}
+}
@@ -5,17 +5,28 @@ package filter
 
 import (
 	"bytes"
+	"embed"
+	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
 	"net"
+	"os"
 	"path"
+	"path/filepath"
 	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"text/template"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/aletheia7/banip/list"
 	br "github.com/aletheia7/banip/rbl"
+	"github.com/aletheia7/banip/source"
 	"github.com/aletheia7/gogroup"
 	"github.com/aletheia7/mbus"
 	"github.com/aletheia7/sd/v6"
@@ -29,144 +40,1364 @@ var (
 	Rbls     = []string{}
 )
 
+// Bus topics. A match is published with the topic of the filter action.
+// Journal lines are published to their SYSLOG_IDENTIFIER, the banip: prefix
+// keeps i.e. a program named log off the action topics.
 const (
-	T_test  = `test`
-	T_bl    = `bl`
-	T_wl    = `wl`
-	ipv4var = `{{.Ipv4}}`
-	ipv4re  = `(?P<ipv4>\d{1,3}(?:[.]\d{1,3}){3}){1}`
-	ipv4    = `$ipv4`
+	T_test   = `banip:test`
+	T_bl     = `banip:bl`
+	T_wl     = `banip:wl`
+	T_log    = `banip:log`
+	T_strike = `banip:strike`
+	T_rbl    = `banip:rbl`
+	// Every journal line, for filters with journal matches and no
+	// syslog_identifier
+	T_any = `banip:any`
+	// Prefix of the topic of a source other than the journal
+	T_source = `banip:source:`
 )
 
+// Actions maps the toml action key to its topic. Default: ban
+var Actions = map[string]string{
+	// blacklist
+	`ban`: T_bl,
+	// whitelist, i.e. after a successful login. Removes a ban.
+	`whitelist`: T_wl,
+	// log only
+	`log`: T_log,
+	// count a strike, no ban
+	`strike`: T_strike,
+	// ban when the IP is on an rbl
+	`rbl`: T_rbl,
+}
+
+const (
+	ipv4re = `\d{1,3}(?:[.]\d{1,3}){3}`
+	ipv6re = `(?:[0-9A-Fa-f]{0,4}:){2,7}(?:[0-9A-Fa-f]{1,4}|` + ipv4re + `)?`
+)
+
+// Vars are the template variables of re, i.e. {{.Ip}}. A re must have one
+// of Ip, Ipv4 or Ipv6. The other named groups are saved in Action.Fields.
+var Vars = map[string]string{
+	// IPv4 or IPv6
+	`Ip`:   `(?P<ip>` + ipv4re + `|` + ipv6re + `)`,
+	`Ipv4`: `(?P<ipv4>` + ipv4re + `)`,
+	`Ipv6`: `(?P<ipv6>` + ipv6re + `)`,
+	`Host`: `(?P<host>[A-Za-z0-9](?:[A-Za-z0-9-]*[A-Za-z0-9])?(?:[.][A-Za-z0-9](?:[A-Za-z0-9-]*[A-Za-z0-9])?)*)`,
+	`Port`: `(?P<port>\d{1,5})`,
+	`User`: `(?P<user>[^\s,;<>\[\]]*)`,
+	// postfix short and long queue id
+	`Qid`: `(?P<qid>[0-9A-F]{6,12}|[0-9B-DF-HJ-NP-TV-Zb-df-hj-np-tv-z]{10,})`,
+	// RFC 3339 or syslog
+	`Timestamp`: `(?P<timestamp>\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}(?:[.]\d+)?(?:Z|[+-]\d{2}:?\d{2})?|[A-Z][a-z]{2} [ \d]\d \d{2}:\d{2}:\d{2})`,
+}
+
+// Vars_file holds user variables beside the filter toml files:
+//
+//	Sasl = '(?P<sasl>\S+)'
+const Vars_file = `vars.toml`
+
+// The IP groups of Vars
+var ip_groups = map[string]bool{`ip`: true, `ipv4`: true, `ipv6`: true}
+
 type Action struct {
-	Toml      string
-	Ip        string
-	Msg       string
+	Toml string
+	Ip   string
+	Msg  string
+	// Named groups of the re other than the IP
+	Fields    map[string]string
 	Check_rbl bool
 	Rbl       interface{}
+	// 0: server default
+	Ban_duration time.Duration
 }
 
+// Line is a journal line with its journal fields
+type Line struct {
+	Msg    string
+	Fields map[string]string
+}
+
+// journal field name
+var field_re = regexp.MustCompile(`^[A-Z0-9_]+$`)
+
 type Filter struct {
-	parent, gg        *gogroup.Group
-	bus               *mbus.Bus
-	c                 chan *mbus.Msg
-	Name              string
+	parent, gg *gogroup.Group
+	bus        *mbus.Bus
+	c          chan *mbus.Msg
+	Name       string
+	// Name of the built-in filter of the toml, if any
+	Builtin           string
 	Enabled           bool
 	Action            string
+	topic             string
 	Tag               []string
-	Re, Ignore        []*regexp.Regexp
+	Journal           map[string][]string
+	Source            string
+	Rule              []*Rule
+	Ignore            []*regexp.Regexp
+	Ignore_ip         *list.W
+	vars              map[string]string
 	Rbl_use, Rbl_must bool
-	testdata          []string
-	subs              []string
-	matched           int
-	matched_u         map[string]bool
-	ignored           int
-	total             int
-	list              *list.WB
-	rbl               *br.Search
+	Ban_duration      time.Duration
+	// Publish when Maxretry matches of an IP are within Findtime
+	Maxretry  int
+	Findtime  time.Duration
+	Correlate []*Correlate
+	hits      map[string][]hit
+	// journal time of the last line and when it was seen, the clock of the
+	// Correlate windows
+	last, last_at time.Time
+	// -test replay: fired Correlate sequences are counted, not published
+	replay    bool
+	fired     int
+	testdata  []*Testdata
+	subs      []string
+	topics    []string
+	dispatch  *Dispatcher
+	matched   int
+	matched_u map[string]bool
+	ignored   int
+	total     int
+	list      *list.WB
+	rbl       *br.Search
+	// matches dropped by the Dispatcher when c is full
+	dropped int
+}
+
+// Rule lines matching Ignore are ignored
+type Rule struct {
+	Re     *regexp.Regexp
+	Ignore []*regexp.Regexp
+	// A match starts with prefix and contains lit, src: re of the toml
+	prefix, lit, src string
+}
+
+// literals sets prefix and lit of Re
+func (o *Rule) literals() {
+	if sre, err := syntax.Parse(o.Re.String(), syntax.Perl); err == nil {
+		sre = sre.Simplify()
+		o.prefix, o.lit = prefix(sre), literal(sre)
+	}
+}
+
+// Correlate is a multi-line rule. A line matching Start opens a sequence of
+// its Key, the lines of the key must then match Follow in order within
+// Window. Key is a named group of the patterns, i.e. ip, or a journal field,
+// i.e. SYSLOG_PID. A line matching Unless closes the sequence without a ban.
+type Correlate struct {
+	Start  *Rule
+	Follow []*Step
+	Unless []*Rule
+	Key    string
+	Window time.Duration
+	// false: ban when Follow completes within Window. true: ban when Window
+	// ends before Follow completes.
+	Timeout bool
+	// Key is a journal field
+	field bool
+	// open sequences by key
+	open map[string]*sequence
+}
+
+// Step of Follow: Count lines matching Re
+type Step struct {
+	Rule
+	Count int
+}
+
+// An open sequence of a Correlate
+type sequence struct {
+	start time.Time
+	// Follow index, lines matched of the step
+	step, n int
+	// The last captured IP
+	ip     string
+	fields map[string]string
+	lines  []string
+}
+
+// add saves msg and the captures m of re
+func (o *sequence) add(re *regexp.Regexp, m []string, msg string) {
+	o.lines = append(o.lines, msg)
+	for gi, name := range re.SubexpNames() {
+		switch {
+		case len(m[gi]) == 0:
+		case ip_groups[name]:
+			o.ip = m[gi]
+		case 0 < len(name):
+			if o.fields == nil {
+				o.fields = map[string]string{}
+			}
+			o.fields[name] = m[gi]
+		}
+	}
+}
+
+// find matches msg with r. key is the Key of the line, empty: no match.
+func (o *Correlate) find(r *Rule, msg string, fields map[string]string) (key string, m []string) {
+	if !r.may_match(msg) {
+		return
+	}
+	if m = r.Re.FindStringSubmatch(msg); m == nil {
+		return
+	}
+	if o.field {
+		return fields[o.Key], m
+	}
+	if i := r.Re.SubexpIndex(o.Key); 0 < i {
+		return m[i], m
+	}
+	return ``, nil
+}
+
+// line advances the sequences with msg and returns a sequence that fires
+func (o *Correlate) line(msg string, fields map[string]string, now time.Time) *sequence {
+	for _, r := range o.Unless {
+		if key, _ := o.find(r, msg, fields); 0 < len(key) {
+			delete(o.open, key)
+			return nil
+		}
+	}
+	for i, st := range o.Follow {
+		key, m := o.find(&st.Rule, msg, fields)
+		s := o.open[key]
+		if s == nil || s.step != i {
+			continue
+		}
+		s.add(st.Re, m, msg)
+		if s.n++; s.n < st.Count {
+			return nil
+		}
+		s.step, s.n = s.step+1, 0
+		if s.step < len(o.Follow) {
+			return nil
+		}
+		delete(o.open, key)
+		if o.Timeout {
+			return nil
+		}
+		return s
+	}
+	// An open sequence is not restarted
+	if key, m := o.find(o.Start, msg, fields); 0 < len(key) && o.open[key] == nil {
+		s := &sequence{start: now}
+		s.add(o.Start.Re, m, msg)
+		o.open[key] = s
+	}
+	return nil
+}
+
+// expire closes the sequences older than Window and returns the sequences
+// that fire
+func (o *Correlate) expire(now time.Time) (a []*sequence) {
+	for key, s := range o.open {
+		if s.start.Add(o.Window).Before(now) {
+			delete(o.open, key)
+			if o.Timeout {
+				a = append(a, s)
+			}
+		}
+	}
+	return
+}
+
+// patterns calls fn with each pattern and its name: start, follow[0], ...
+func (o *Correlate) patterns(fn func(name string, r *Rule)) {
+	fn(`start`, o.Start)
+	for i, st := range o.Follow {
+		fn(fmt.Sprintf("follow[%v]", i), &st.Rule)
+	}
+	for i, r := range o.Unless {
+		fn(fmt.Sprintf("unless[%v]", i), r)
+	}
+}
+
+// may_match is false when no pattern matches msg
+func (o *Correlate) may_match(msg string) bool {
+	if o.Start.may_match(msg) && o.Start.Re.MatchString(msg) {
+		return true
+	}
+	for _, st := range o.Follow {
+		if st.may_match(msg) && st.Re.MatchString(msg) {
+			return true
+		}
+	}
+	for _, r := range o.Unless {
+		if r.may_match(msg) && r.Re.MatchString(msg) {
+			return true
+		}
+	}
+	return false
+}
+
+//go:embed builtin/*.toml
+var builtin embed.FS
+
+// Builtins returns the names of the built-in filters
+func Builtins() []string {
+	a, _ := fs.Glob(builtin, `builtin/*.toml`)
+	for i, fn := range a {
+		a[i] = strings.TrimSuffix(path.Base(fn), `.toml`)
+	}
+	return a
+}
+
+// Builtin returns the toml of the built-in filter name
+func Builtin(name string) ([]byte, error) {
+	b, err := builtin.ReadFile(`builtin/` + name + `.toml`)
+	if err != nil {
+		return nil, fmt.Errorf("unknown builtin: %v, use: %v", name, strings.Join(Builtins(), `, `))
+	}
+	return b, nil
+}
+
+type option func(*Filter)
+
+// Dispatch makes d match the live lines of the filter
+func Dispatch(d *Dispatcher) option {
+	return func(o *Filter) {
+		o.dispatch = d
+	}
+}
+
+// A match of a Dispatcher sent to the filter goroutine
+type match struct {
+	msg string
+	r   Result
+	// journal fields of the line: Correlate key and time
+	fields map[string]string
+}
+
+// t_match is the topic of a match on Filter.c
+const t_match = `match`
+
+// A matched line
+type hit struct {
+	ts  time.Time
+	msg string
 }
 
 type Get_it interface {
 	In_list(ip net.IP) bool
 }
 
-func New(gg *gogroup.Group, bus *mbus.Bus, fn string, list *list.WB, rbls []string) (*Filter, error) {
+func New(gg *gogroup.Group, bus *mbus.Bus, fn string, wb *list.WB, rbls []string, opt ...option) (*Filter, error) {
+	o, err := Load(fn, opt...)
+	if err != nil {
+		j.Err(err)
+		return nil, err
+	}
+	o.parent = gg
+	o.gg = gogroup.New(gogroup.With_cancel(gg))
+	o.bus = bus
+	o.c = make(chan *mbus.Msg, 256)
+	o.list = wb
+	o.rbl = br.New(gg, rbls)
+	o.subs = []string{T_test}
+	if o.dispatch == nil {
+		o.subs = append(o.subs, o.topics...)
+	} else {
+		o.dispatch.add(o, o.topics...)
+	}
+	o.bus.Subscribe(o.c, o.subs...)
+	go o.run()
+	return o, nil
+}
+
+// Load decodes the toml file fn without subscribing or starting the filter
+func Load(fn string, opt ...option) (*Filter, error) {
 	if ext := path.Ext(fn); ext != ".toml" {
-		e := fmt.Errorf("missing toml file: %v", fn)
-		j.Err(e)
-		return nil, e
+		return nil, fmt.Errorf("missing toml file: %v", fn)
 	}
 	o := &Filter{
-		parent:    gg,
-		gg:        gogroup.New(gogroup.With_cancel(gg)),
-		bus:       bus,
-		c:         make(chan *mbus.Msg, 256),
 		Name:      strings.Split(path.Base(fn), ".toml")[0],
-		Re:        make([]*regexp.Regexp, 0),
+		Action:    `ban`,
+		topic:     T_bl,
+		Source:    source.Journal,
+		Maxretry:  1,
+		Findtime:  time.Minute * 10,
+		hits:      map[string][]hit{},
+		Rule:      make([]*Rule, 0),
 		Ignore:    make([]*regexp.Regexp, 0),
-		testdata:  []string{},
+		Ignore_ip: list.New().W,
+		testdata:  []*Testdata{},
 		matched_u: map[string]bool{},
-		list:      list,
-		rbl:       br.New(gg, rbls),
 	}
-	_, err := toml.DecodeFile(fn, o)
-	if err != nil {
-		j.Err("decode:", err)
-		return nil, err
+	vars, err := Load_vars(path.Join(path.Dir(fn), Vars_file))
+	if err != nil {
+		return nil, err
+	}
+	o.vars = vars
+	for _, op := range opt {
+		op(o)
+	}
+	if _, err = toml.DecodeFile(fn, o); err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+	switch {
+	case o.Source != source.Journal:
+		o.topics = []string{T_source + o.Source}
+	case len(o.Tag) == 0 && 0 < len(o.Journal):
+		o.topics = []string{T_any}
+	default:
+		o.topics = o.Tag
+	}
+	return o, nil
+}
+
+// Call Stop() to shutdown
+func (o *Filter) Stop() {
+	o.gg.Cancel()
+}
+
+func (o *Filter) run() {
+	key := o.gg.Register()
+	defer o.gg.Unregister(key)
+	defer o.bus.Unsubscribe(o.c, o.subs...)
+	if o.dispatch != nil {
+		defer o.dispatch.remove(o, o.topics...)
+	}
+	sweep := time.NewTicker(o.Findtime)
+	defer sweep.Stop()
+	// Correlate windows
+	var tick <-chan time.Time
+	if 0 < len(o.Correlate) {
+		t := time.NewTicker(time.Second)
+		defer t.Stop()
+		tick = t.C
+	}
+	for {
+		select {
+		case <-o.gg.Done():
+			return
+		case <-tick:
+			if o.last.IsZero() {
+				continue
+			}
+			for _, m := range o.expire(o.last.Add(time.Since(o.last_at))) {
+				if o.replay {
+					o.tested(m)
+				} else {
+					o.act(m.r, m.msg, false)
+				}
+			}
+		case now := <-sweep.C:
+			for ip, a := range o.hits {
+				if a[len(a)-1].ts.Add(o.Findtime).Before(now) {
+					delete(o.hits, ip)
+				}
+			}
+		case in := <-o.c:
+			switch in.Topic {
+			case T_test:
+				o.test(in)
+			default:
+				o.check(in)
+			}
+		}
+	}
+}
+
+// Testdata is a testdata entry. Verdict, Ip and Fields are checked when
+// set, a string entry only has Line.
+type Testdata struct {
+	Line    string
+	Verdict string            `json:",omitempty"`
+	Ip      string            `json:",omitempty"`
+	Fields  map[string]string `json:",omitempty"`
+}
+
+// check returns the mismatches of r
+func (o *Testdata) check(r Result) (a []string) {
+	if 0 < len(o.Verdict) && r.Verdict != o.Verdict {
+		a = append(a, fmt.Sprintf("verdict: %v, expected: %v", r.Verdict, o.Verdict))
+	}
+	if 0 < len(o.Ip) && r.Ip != o.Ip {
+		a = append(a, fmt.Sprintf("ip: %v, expected: %v", r.Ip, o.Ip))
+	}
+	keys := make([]string, 0, len(o.Fields))
+	for k := range o.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if r.Fields[k] != o.Fields[k] {
+			a = append(a, fmt.Sprintf("%v: %q, expected: %q", k, r.Fields[k], o.Fields[k]))
+		}
+	}
+	return
+}
+
+// Report is the -testdata result of a toml
+type Report struct {
+	Toml                                    string
+	Total, Matched, Ignored, Missed, Failed int
+	Results                                 []Testdata_result
+	// The toml did not load
+	Err string `json:",omitempty"`
+}
+
+type Testdata_result struct {
+	Testdata
+	Result Result
+	// Mismatches of Result
+	Err []string `json:",omitempty"`
+}
+
+// Testdata evaluates the testdata like live matching, without rbl_must
+func (o *Filter) Testdata() *Report {
+	if o.Rbl_must {
+		j.Info("rbl_must is not used with testdata")
+	}
+	rep := &Report{Toml: o.Name, Results: make([]Testdata_result, 0, len(o.testdata))}
+	for _, t := range o.testdata {
+		rep.Total++
+		r := o.eval(t.Line)
+		switch r.Verdict {
+		case Matched:
+			rep.Matched++
+			if *pmatched {
+				j.Infof("matched: %s %v\n%v\n", r.Ip, r.By, t.Line)
+			}
+		case Ignored:
+			rep.Ignored++
+			if *pignored {
+				j.Infof("ignored: %s\n", r.By)
+			}
+		default:
+			rep.Missed++
+			if *pmissed {
+				j.Infof("missed: %s\n", t.Line)
+			}
+		}
+		res := Testdata_result{Testdata: *t, Result: r, Err: t.check(r)}
+		if 0 < len(res.Err) {
+			rep.Failed++
+			j.Warningf("fail: %v: %v: %v", o.Name, t.Line, strings.Join(res.Err, `, `))
+		}
+		rep.Results = append(rep.Results, res)
+	}
+	j.Infof("%v: matched: %v, ignored: %v, missed: %v, failed: %v, total: %v\n", o.Name, rep.Matched, rep.Ignored, rep.Missed, rep.Failed, rep.Total)
+	return rep
+}
+
+// Problem is a -lint finding of a toml. Line 0: unknown.
+type Problem struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (o Problem) String() string {
+	if o.Line == 0 {
+		return fmt.Sprintf("%v: %v", o.File, o.Msg)
+	}
+	return fmt.Sprintf("%v:%v: %v", o.File, o.Line, o.Msg)
+}
+
+// A rule of a toml, duplicate detection
+type rule_at struct {
+	fn string
+	i  int
+}
+
+// Lint loads the filters of dir without starting them and returns the
+// problems: load errors, no re or testdata, a re or correlate pattern
+// matching none of the testdata, failed testdata, a rule ignore shadowed by
+// an earlier re, a re duplicated across the filters and a syslog_identifier
+// not in tags. tags nil: not checked.
+func Lint(dir string, tags map[string]bool) []Problem {
+	r := []Problem{}
+	fns, err := filepath.Glob(filepath.Join(dir, "*.toml"))
+	if err != nil {
+		return append(r, Problem{File: dir, Msg: err.Error()})
+	}
+	seen := map[string]rule_at{}
+	for _, fn := range fns {
+		if filepath.Base(fn) == Vars_file {
+			continue
+		}
+		b, err := os.ReadFile(fn)
+		if err != nil {
+			r = append(r, Problem{File: fn, Msg: err.Error()})
+			continue
+		}
+		text := strings.Split(string(b), "\n")
+		at := func(s, format string, a ...interface{}) {
+			r = append(r, Problem{File: fn, Line: line_of(text, s), Msg: fmt.Sprintf(format, a...)})
+		}
+		o, err := Load(fn)
+		if err != nil {
+			p := Problem{File: fn, Msg: err.Error()}
+			var pe toml.ParseError
+			if errors.As(err, &pe) {
+				p.Line = pe.Position.Line
+			}
+			r = append(r, p)
+			continue
+		}
+		if len(o.Rule) == 0 && len(o.Correlate) == 0 {
+			at(``, "no re")
+		}
+		if len(o.testdata) == 0 {
+			at(``, "no testdata")
+		}
+		if o.Source == source.Journal && len(o.Tag) == 0 && len(o.Journal) == 0 {
+			at(``, "no syslog_identifier, journal or source")
+		}
+		for i, rule := range o.Rule {
+			if first, ok := seen[rule.Re.String()]; ok {
+				at(rule.src, "re[%v] duplicates %v re[%v]", i, first.fn, first.i)
+			} else {
+				seen[rule.Re.String()] = rule_at{fn: fn, i: i}
+			}
+			if len(o.testdata) == 0 {
+				continue
+			}
+			used := false
+			for _, t := range o.testdata {
+				if rule.Re.MatchString(t.Line) {
+					used = true
+					break
+				}
+			}
+			if !used {
+				at(rule.src, "re[%v] matches none of the testdata", i)
+			}
+			for _, ig := range rule.Ignore {
+				for _, t := range o.testdata {
+					if !ig.MatchString(t.Line) || !rule.Re.MatchString(t.Line) {
+						continue
+					}
+					if res := o.eval(t.Line); res.Verdict == Matched && res.Rule != i {
+						at(ig.String(), "re[%v].ignore %v is shadowed by re[%v]: %v", i, ig, res.Rule, t.Line)
+						break
+					}
+				}
+			}
+		}
+		for i, c := range o.Correlate {
+			if len(o.testdata) == 0 {
+				break
+			}
+			c.patterns(func(name string, r *Rule) {
+				for _, t := range o.testdata {
+					if r.Re.MatchString(t.Line) {
+						return
+					}
+				}
+				at(r.src, "correlate[%v].%v matches none of the testdata", i, name)
+			})
+		}
+		for _, t := range o.testdata {
+			if e := t.check(o.eval(t.Line)); 0 < len(e) {
+				at(t.Line, "testdata: %v", strings.Join(e, `, `))
+			}
+		}
+		if tags != nil && o.Source == source.Journal {
+			for _, tag := range o.Tag {
+				if !tags[tag] {
+					at(tag, "syslog_identifier %v is not in the journal", tag)
+				}
+			}
+		}
+	}
+	return r
+}
+
+// line_of returns the first line number of s quoted, else of s. 0: not found.
+func line_of(text []string, s string) int {
+	if len(s) == 0 {
+		return 0
+	}
+	for _, q := range []string{`'` + s + `'`, `"` + s + `"`, s} {
+		for i, l := range text {
+			if strings.Contains(l, q) {
+				return i + 1
+			}
+		}
+	}
+	return 0
+}
+
+func (o *Filter) check(in *mbus.Msg) {
+	select {
+	case <-o.gg.Done():
+		return
+	default:
+		var (
+			msg    string
+			r      Result
+			fields map[string]string
+			ok     bool
+		)
+		if m, is := in.Data.(*match); is {
+			msg, r, fields = m.msg, m.r, m.fields
+		} else if msg, ok = o.line(in.Data); ok {
+			r, fields = o.eval(msg), fields_of(in.Data)
+		} else {
+			return
+		}
+		for _, m := range o.correlate(msg, fields) {
+			o.act(m.r, m.msg, false)
+		}
+		if r.Verdict == Matched {
+			o.act(r, msg, true)
+		}
+	}
+}
+
+// act publishes the action of a match unless the IP is listed. retry: the
+// match counts towards Maxretry.
+func (o *Filter) act(r Result, msg string, retry bool) {
+	ipnet := net.ParseIP(r.Ip)
+	// whitelist removes a ban
+	if o.list.W.Lookup(ipnet) || (o.topic != T_wl && o.list.B.Lookup(ipnet)) {
+		return
+	}
+	if retry {
+		var ok bool
+		if msg, ok = o.retry(r.Ip, msg, time.Now()); !ok {
+			return
+		}
+	}
+	if o.Rbl_must {
+		select {
+		case <-o.gg.Done():
+			return
+		default:
+			if a := o.rbl.Lookup(ipnet, true); 0 < len(a) {
+				o.bus.Pub(o.topic, &Action{Toml: o.Name, Ip: r.Ip, Msg: msg, Fields: r.Fields, Rbl: a[0], Ban_duration: o.Ban_duration})
+			}
+		}
+	} else {
+		o.bus.Pub(o.topic, &Action{Toml: o.Name, Ip: r.Ip, Msg: msg, Fields: r.Fields, Check_rbl: o.Rbl_use, Ban_duration: o.Ban_duration})
+	}
+}
+
+// correlate advances the Correlate sequences with msg and returns the
+// sequences that fire as matches
+func (o *Filter) correlate(msg string, fields map[string]string) []*match {
+	if len(o.Correlate) == 0 {
+		return nil
+	}
+	now := o.clock(fields)
+	a := o.expire(now)
+	for i, c := range o.Correlate {
+		if s := c.line(msg, fields, now); s != nil {
+			a = o.fire(a, i, s)
+		}
+	}
+	return a
+}
+
+// expire returns the sequences that fire at now
+func (o *Filter) expire(now time.Time) (a []*match) {
+	for i, c := range o.Correlate {
+		for _, s := range c.expire(now) {
+			a = o.fire(a, i, s)
+		}
+	}
+	return
+}
+
+// fire appends the match of sequence s of Correlate i, unless the IP is
+// invalid or in ignore_ip
+func (o *Filter) fire(a []*match, i int, s *sequence) []*match {
+	ipnet := net.ParseIP(s.ip)
+	if ipnet == nil || o.Ignore_ip.Lookup(ipnet) {
+		return a
+	}
+	r := Result{Verdict: Matched, Ip: s.ip, Rule: -1, By: fmt.Sprintf("correlate[%v]", i), Fields: s.fields}
+	return append(a, &match{msg: strings.Join(s.lines, "\n"), r: r})
+}
+
+// clock returns the journal time of fields, else now. The last line time
+// drives expire: a -test replay runs in journal time.
+func (o *Filter) clock(fields map[string]string) time.Time {
+	now := time.Now()
+	t := now
+	if us, err := strconv.ParseInt(fields[`__REALTIME_TIMESTAMP`], 10, 64); err == nil {
+		t = time.UnixMicro(us)
+	}
+	o.last, o.last_at = t, now
+	return t
+}
+
+// fields_of returns the journal fields of a *Line
+func fields_of(data interface{}) map[string]string {
+	if l, ok := data.(*Line); ok {
+		return l.Fields
+	}
+	return nil
+}
+
+// may_correlate is false when no Correlate pattern matches msg
+func (o *Filter) may_correlate(msg string) bool {
+	for _, c := range o.Correlate {
+		if c.may_match(msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// line returns the message of a string or a *Line. ok is false when the
+// journal matches do not apply.
+func (o *Filter) line(data interface{}) (msg string, ok bool) {
+	switch t := data.(type) {
+	case string:
+		return t, true
+	case *Line:
+		return t.Msg, o.match(t.Fields)
+	}
+	return
+}
+
+// match reports whether the journal fields satisfy Journal: values of a field
+// are or'ed, fields are and'ed. Tag is matched here for sources other than
+// the journal.
+func (o *Filter) match(fields map[string]string) bool {
+	if o.Source != source.Journal && 0 < len(o.Tag) {
+		found := false
+		for _, t := range o.Tag {
+			if t == fields[`SYSLOG_IDENTIFIER`] {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for k, a := range o.Journal {
+		v, ok := fields[k]
+		if !ok {
+			return false
+		}
+		found := false
+		for _, s := range a {
+			if s == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Journal_match returns the journalctl matches of syslog_identifier and
+// journal, i.e. SYSLOG_IDENTIFIER=sshd _SYSTEMD_UNIT=ssh.service
+func (o *Filter) Journal_match() []string {
+	r := make([]string, 0, len(o.Tag)+len(o.Journal))
+	for _, t := range o.Tag {
+		r = append(r, `SYSLOG_IDENTIFIER=`+t)
+	}
+	keys := make([]string, 0, len(o.Journal))
+	for k := range o.Journal {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range o.Journal[k] {
+			r = append(r, k+`=`+v)
+		}
+	}
+	return r
+}
+
+func (o *Rule) may_match(msg string) bool {
+	return strings.HasPrefix(msg, o.prefix) && strings.Contains(msg, o.lit)
+}
+
+// prefix returns the literal after ^ of re
+func prefix(re *syntax.Regexp) string {
+	if re.Op != syntax.OpConcat || len(re.Sub) < 2 || re.Sub[0].Op != syntax.OpBeginText {
+		return ``
+	}
+	if sub := re.Sub[1]; sub.Op == syntax.OpLiteral && sub.Flags&syntax.FoldCase == 0 {
+		return string(sub.Rune)
+	}
+	return ``
+}
+
+// literal returns the longest literal in every match of re
+func literal(re *syntax.Regexp) string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase == 0 {
+			return string(re.Rune)
+		}
+	case syntax.OpCapture, syntax.OpPlus:
+		return literal(re.Sub[0])
+	case syntax.OpRepeat:
+		if 0 < re.Min {
+			return literal(re.Sub[0])
+		}
+	case syntax.OpConcat:
+		best, run := ``, ``
+		for _, sub := range re.Sub {
+			if sub.Op == syntax.OpLiteral && sub.Flags&syntax.FoldCase == 0 {
+				run += string(sub.Rune)
+				if len(best) < len(run) {
+					best = run
+				}
+				continue
+			}
+			run = ``
+			if s := literal(sub); len(best) < len(s) {
+				best = s
+			}
+		}
+		return best
+	}
+	return ``
+}
+
+// Dispatcher matches the live lines of all filters in one goroutine. A rule is
+// evaluated when the line has its prefix and literal. The literals of the
+// unanchored rules of a topic are found in one scan of the line, a match goes
+// to the filter goroutine. A filter busy with an RBL lookup does not stall the
+// others: a match is dropped when the filter queue is full.
+type Dispatcher struct {
+	bus *mbus.Bus
+	c   chan *mbus.Msg
+	mu  sync.RWMutex
+	// filters by topic, replaced on change
+	f map[string][]*Filter
+	// index of f by topic, replaced on change
+	idx map[string]*index
+}
+
+func New_dispatcher(gg *gogroup.Group, bus *mbus.Bus) *Dispatcher {
+	o := &Dispatcher{
+		bus: bus,
+		c:   make(chan *mbus.Msg, 1024),
+		f:   map[string][]*Filter{},
+		idx: map[string]*index{},
+	}
+	go o.run(gg)
+	return o
+}
+
+func (o *Dispatcher) run(gg *gogroup.Group) {
+	key := gg.Register()
+	defer gg.Unregister(key)
+	for {
+		select {
+		case <-gg.Done():
+			return
+		case in := <-o.c:
+			o.dispatch(in.Topic, in.Data, o.send)
+		}
+	}
+}
+
+// send queues m without blocking, a full queue drops m
+func (o *Dispatcher) send(f *Filter, m *match) {
+	select {
+	case f.c <- mbus.New_msg(t_match, m):
+	default:
+		if f.dropped++; f.dropped == 1 || f.dropped%1000 == 0 {
+			j.Warningf("%v: queue full, dropped: %v", f.Name, f.dropped)
+		}
+	}
+}
+
+// dispatch calls fn for each filter of topic matching data
+func (o *Dispatcher) dispatch(topic string, data interface{}, fn func(*Filter, *match)) {
+	o.mu.RLock()
+	x := o.idx[topic]
+	o.mu.RUnlock()
+	if x == nil {
+		return
+	}
+	scanned := false
+	for i, f := range x.f {
+		msg, ok := f.line(data)
+		if !ok {
+			continue
+		}
+		var c *candidates
+		if x.ac != nil {
+			if !scanned {
+				x.ac.scan(msg, x.found)
+				scanned = true
+			}
+			c = &candidates{found: x.found, lid: x.lid[i]}
+		}
+		var r Result
+		for ri, rule := range f.Rule {
+			if c.may(ri, rule, msg) {
+				r = f.trace(msg, c, nil)
+				break
+			}
+		}
+		if r.Verdict == Matched || f.may_correlate(msg) {
+			fn(f, &match{msg: msg, r: r, fields: fields_of(data)})
+		}
+	}
+}
+
+func (o *Dispatcher) add(f *Filter, topic ...string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, t := range topic {
+		a := o.f[t]
+		if len(a) == 0 {
+			o.bus.Subscribe(o.c, t)
+		}
+		o.f[t] = append(a[:len(a):len(a)], f)
+		o.idx[t] = new_index(o.f[t])
+	}
+}
+
+func (o *Dispatcher) remove(f *Filter, topic ...string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, t := range topic {
+		a := make([]*Filter, 0, len(o.f[t]))
+		for _, v := range o.f[t] {
+			if v != f {
+				a = append(a, v)
+			}
+		}
+		if 0 < len(a) {
+			o.f[t] = a
+			o.idx[t] = new_index(a)
+			continue
+		}
+		delete(o.f, t)
+		delete(o.idx, t)
+		o.bus.Unsubscribe(o.c, t)
+	}
+}
+
+// min_scan is the number of unanchored literals of a topic from which one
+// automaton scan is faster than strings.Contains of each
+var min_scan = 8
+
+// index is the combined matcher of the filters of a topic
+type index struct {
+	f []*Filter
+	// lid[i][r]: the literal id of unanchored f[i].Rule[r], -1: none
+	lid [][]int
+	// nil: fewer than min_scan literals
+	ac *automaton
+	// The literals found in the line, only used by the dispatch goroutine
+	found []bool
+}
+
+// candidates are the rules of a filter with a literal found by an index
+type candidates struct {
+	found []bool
+	lid   []int
+}
+
+// may reports whether rule i can match msg. Without a literal id, or nil, the
+// rule prefix and literal are checked.
+func (o *candidates) may(i int, rule *Rule, msg string) bool {
+	if o == nil || o.lid[i] < 0 {
+		return rule.may_match(msg)
+	}
+	return o.found[o.lid[i]]
+}
+
+func new_index(f []*Filter) *index {
+	o := &index{f: f, lid: make([][]int, len(f))}
+	ids := map[string]int{}
+	lits := []string{}
+	for i, fi := range f {
+		o.lid[i] = make([]int, len(fi.Rule))
+		for r, rule := range fi.Rule {
+			// An anchored rule is skipped by its prefix
+			if len(rule.lit) == 0 || 0 < len(rule.prefix) {
+				o.lid[i][r] = -1
+				continue
+			}
+			id, ok := ids[rule.lit]
+			if !ok {
+				id = len(lits)
+				ids[rule.lit] = id
+				lits = append(lits, rule.lit)
+			}
+			o.lid[i][r] = id
+		}
+	}
+	if len(lits) < min_scan {
+		return o
+	}
+	o.ac = new_automaton(lits)
+	o.found = make([]bool, len(lits))
+	return o
+}
+
+// automaton is an Aho-Corasick automaton of literals as a DFA over the byte
+// classes of the literals: scan is one table lookup per byte.
+type automaton struct {
+	// literals, byte classes
+	n, classes int
+	class      [256]int32
+	// delta[state*classes+class]: the next state as offset<<1 | 1 when
+	// literals end at it, offset: state*classes
+	delta []int32
+	// literal ids ending at a state
+	out [][]int
+}
+
+func new_automaton(lits []string) *automaton {
+	o := &automaton{n: len(lits), classes: 1}
+	for _, s := range lits {
+		for i := 0; i < len(s); i++ {
+			if o.class[s[i]] == 0 {
+				o.class[s[i]] = int32(o.classes)
+				o.classes++
+			}
+		}
+	}
+	// next[state*classes+class]: the next state. The trie, -1: no edge
+	next := []int{}
+	state := func() int {
+		for i := 0; i < o.classes; i++ {
+			next = append(next, -1)
+		}
+		o.out = append(o.out, nil)
+		return len(o.out) - 1
+	}
+	state()
+	for id, s := range lits {
+		st := 0
+		for i := 0; i < len(s); i++ {
+			e := st*o.classes + int(o.class[s[i]])
+			if next[e] < 0 {
+				next[e] = state()
+			}
+			st = next[e]
+		}
+		o.out[st] = append(o.out[st], id)
+	}
+	// Breadth first: a missing edge takes the edge of the fail state
+	fail := make([]int, len(o.out))
+	queue := []int{}
+	for c := 0; c < o.classes; c++ {
+		if st := next[c]; st < 0 {
+			next[c] = 0
+		} else {
+			queue = append(queue, st)
+		}
+	}
+	for 0 < len(queue) {
+		st := queue[0]
+		queue = queue[1:]
+		o.out[st] = append(o.out[st], o.out[fail[st]]...)
+		for c := 0; c < o.classes; c++ {
+			e := st*o.classes + c
+			if child := next[e]; child < 0 {
+				next[e] = next[fail[st]*o.classes+c]
+			} else {
+				fail[child] = next[fail[st]*o.classes+c]
+				queue = append(queue, child)
+			}
+		}
+	}
+	o.delta = make([]int32, len(next))
+	for e, st := range next {
+		o.delta[e] = int32(st*o.classes) << 1
+		if 0 < len(o.out[st]) {
+			o.delta[e] |= 1
+		}
+	}
+	return o
+}
+
+// scan sets found[id] of the literals in s
+func (o *automaton) scan(s string, found []bool) {
+	for i := range found {
+		found[i] = false
+	}
+	if o.n == 0 {
+		return
+	}
+	var off int32
+	for i := 0; i < len(s); i++ {
+		v := o.delta[off+o.class[s[i]]]
+		off = v >> 1
+		if v&1 != 0 {
+			for _, id := range o.out[int(off)/o.classes] {
+				found[id] = true
+			}
+		}
 	}
-	o.subs = make([]string, 0, len(o.Tag)+1)
-	o.subs = append(o.subs, o.Tag...)
-	o.subs = append(o.subs, T_test)
-	o.bus.Subscribe(o.c, o.subs...)
-	go o.run()
-	return o, nil
 }
 
-// Call Stop() to shutdown
-func (o *Filter) Stop() {
-	o.gg.Cancel()
+// Result verdicts
+const (
+	Matched = `matched`
+	Ignored = `ignored`
+	Missed  = `missed`
+)
+
+type Result struct {
+	Verdict string
+	Ip      string
+	// Rule index, -1: none
+	Rule int
+	// The deciding pattern or ignore_ip entry
+	By     string
+	Fields map[string]string
 }
 
-func (o *Filter) run() {
-	key := o.gg.Register()
-	defer o.gg.Unregister(key)
-	defer o.bus.Unsubscribe(o.c, o.subs...)
-	for {
-		select {
-		case <-o.gg.Done():
-			return
-		case in := <-o.c:
-			switch in.Topic {
-			case T_test:
-				o.test(in)
-			default:
-				o.check(in)
+// eval is the rule evaluation of live matching and -test:
+//  1. a filter ignore matches: ignored
+//  2. the first matching rule re wins, a match of its ignore: ignored
+//  3. the IP is in ignore_ip: ignored
+//  4. no rule matches: missed
+func (o *Filter) eval(msg string) Result {
+	return o.trace(msg, nil, nil)
+}
+
+// trace is eval of the candidate rules, c nil: all. step is called with each
+// decision, nil: none.
+func (o *Filter) trace(msg string, c *candidates, step func(format string, a ...interface{})) Result {
+	for _, re := range o.Ignore {
+		if re.MatchString(msg) {
+			if step != nil {
+				step("ignore %v: fired", re)
+			}
+			return Result{Verdict: Ignored, Rule: -1, By: re.String()}
+		}
+		if step != nil {
+			step("ignore %v: no match", re)
+		}
+	}
+	for i, rule := range o.Rule {
+		if !c.may(i, rule, msg) {
+			if step != nil {
+				step("re[%v] %v: skipped, no prefix %q or literal %q", i, rule.Re, rule.prefix, rule.lit)
+			}
+			continue
+		}
+		m := rule.Re.FindStringSubmatch(msg)
+		if m == nil {
+			if step != nil {
+				step("re[%v] %v: no match", i, rule.Re)
+			}
+			continue
+		}
+		r := Result{Verdict: Matched, Rule: i, By: rule.Re.String()}
+		for gi, name := range rule.Re.SubexpNames() {
+			switch {
+			case len(m[gi]) == 0:
+			case ip_groups[name]:
+				if len(r.Ip) == 0 {
+					r.Ip = m[gi]
+				}
+			case 0 < len(name):
+				if r.Fields == nil {
+					r.Fields = map[string]string{}
+				}
+				r.Fields[name] = m[gi]
+			}
+		}
+		if net.ParseIP(r.Ip) == nil {
+			if step != nil {
+				step("re[%v] %v: matched, invalid ip %q, next re", i, rule.Re, r.Ip)
+			}
+			continue
+		}
+		if step != nil {
+			if len(r.Fields) == 0 {
+				step("re[%v] %v: matched, ip: %v", i, rule.Re, r.Ip)
+			} else {
+				step("re[%v] %v: matched, ip: %v, fields: %v", i, rule.Re, r.Ip, r.Fields)
 			}
 		}
+		for _, re := range rule.Ignore {
+			if re.MatchString(msg) {
+				if step != nil {
+					step("re[%v].ignore %v: fired", i, re)
+				}
+				r.Verdict = Ignored
+				r.By = re.String()
+				return r
+			}
+			if step != nil {
+				step("re[%v].ignore %v: no match", i, re)
+			}
+		}
+		if o.Ignore_ip.Lookup(net.ParseIP(r.Ip)) {
+			if step != nil {
+				step("ignore_ip: fired, %v", r.Ip)
+			}
+			r.Verdict = Ignored
+			r.By = `ignore_ip`
+		}
+		return r
 	}
+	return Result{Verdict: Missed, Rule: -1}
 }
 
-func (o *Filter) Testdata() {
-	if o.Rbl_must {
-		o.Rbl_must = false
-		j.Info("setting rbl_must = false testdata only")
+// Explain returns the decision path of msg through the filter, tag: the
+// syslog identifier, empty: any. ok is false when the line does not reach the
+// filter.
+func (o *Filter) Explain(tag, msg string) (steps []string, r Result, ok bool) {
+	step := func(format string, a ...interface{}) {
+		steps = append(steps, fmt.Sprintf(format, a...))
 	}
-	for _, t := range o.testdata {
-		o.c <- mbus.New_msg(T_test, t)
+	if 0 < len(tag) && 0 < len(o.Tag) {
+		found := false
+		for _, t := range o.Tag {
+			found = found || t == tag
+		}
+		if !found {
+			step("syslog_identifier %v: not in %v", tag, o.Tag)
+			return steps, Result{Rule: -1}, false
+		}
+	}
+	if 0 < len(o.Journal) {
+		step("journal %v: not checked", o.Journal)
+	}
+	r = o.trace(msg, nil, step)
+	for i, c := range o.Correlate {
+		c.patterns(func(name string, p *Rule) {
+			if p.may_match(msg) && p.Re.MatchString(msg) {
+				step("correlate[%v].%v %v: matched, key %v, window %v", i, name, p.Re, c.Key, c.Window)
+			}
+		})
 	}
-	o.c <- mbus.New_msg(T_test, nil)
+	step("verdict: %v %v", r.Verdict, r.By)
+	return steps, r, true
 }
 
-func (o *Filter) check(in *mbus.Msg) {
-	select {
-	case <-o.gg.Done():
-		return
-	default:
-		if msg, ok := in.Data.(string); ok {
-			for _, re := range o.Re {
-				if ip := re.ExpandString(nil, ipv4, msg, re.FindStringSubmatchIndex(msg)); ip != nil {
-					ipnet := net.ParseIP(string(ip))
-					if o.list.W.Lookup(ipnet) || o.list.B.Lookup(ipnet) {
-						return
-					}
-					if o.Rbl_must {
-						select {
-						case <-o.gg.Done():
-							return
-						default:
-							if a := o.rbl.Lookup(ipnet, true); 0 < len(a) {
-								o.bus.Pub(T_bl, &Action{Toml: o.Name, Ip: string(ip), Msg: msg, Rbl: a[0]})
-								return
-							}
-						}
-					} else {
-						o.bus.Pub(T_bl, &Action{Toml: o.Name, Ip: string(ip), Msg: msg, Check_rbl: o.Rbl_use})
-						return
-					}
-				}
-			}
-		}
+// Topic is the bus topic of the filter action: T_bl, T_wl, ...
+func (o *Filter) Topic() string {
+	return o.topic
+}
+
+// retry counts a match of ip. ok: Maxretry is reached within Findtime, msg
+// holds the matched lines.
+func (o *Filter) retry(ip, msg string, now time.Time) (string, bool) {
+	if o.Maxretry <= 1 {
+		return msg, true
+	}
+	a := append(o.hits[ip], hit{ts: now, msg: msg})
+	for 0 < len(a) && a[0].ts.Add(o.Findtime).Before(now) {
+		a = a[1:]
 	}
+	if len(a) < o.Maxretry {
+		o.hits[ip] = a
+		return ``, false
+	}
+	delete(o.hits, ip)
+	lines := make([]string, 0, len(a))
+	for _, h := range a {
+		lines = append(lines, h.msg)
+	}
+	return strings.Join(lines, "\n"), true
 }
 
 func (o *Filter) test(in *mbus.Msg) {
@@ -174,71 +1405,95 @@ func (o *Filter) test(in *mbus.Msg) {
 	case <-o.gg.Done():
 		return
 	default:
-		switch msg := in.Data.(type) {
+		switch in.Data.(type) {
 		case nil:
 			j.Infof("total: matched: %v (%v), ignored: %v, missed: %v, total: %v\n", o.matched, len(o.matched_u), o.ignored, o.total-o.matched-o.ignored, o.total)
+			if 0 < len(o.Correlate) {
+				j.Infof("correlated: %v\n", o.fired)
+			}
 			// Call parent to shutdown app gracefully
 			o.parent.Cancel()
 			return
-		case string:
+		default:
+			msg, ok := o.line(in.Data)
+			if !ok {
+				return
+			}
 			o.total++
-			for _, re := range o.Re {
-				s := re.ExpandString(nil, ipv4, msg, re.FindStringSubmatchIndex(msg))
-				if s != nil {
-					if o.Rbl_must {
-						ipnet := net.ParseIP(string(s))
-						if o.list.W.Lookup(ipnet) || o.list.B.Lookup(ipnet) {
-							o.matched++
-							o.matched_u[string(s)] = true
-							if *pmatched {
-								j.Infof("matched: %s %v\n%v\n", s, re.String(), msg)
-							}
-							return
-						}
-						select {
-						case <-o.gg.Done():
-							return
-						default:
-							if a := o.rbl.Lookup(ipnet, true); 0 < len(a) {
-								o.matched++
-								o.matched_u[string(s)] = true
-								if *pmatched {
-									j.Infof("matched: %s %v\n%v\n", s, re.String(), msg)
-								}
-								return
-							}
-						}
-					} else {
-						o.matched++
-						o.matched_u[string(s)] = true
-						if *pmatched {
-							j.Infof("matched: %s %v\n%v\n", s, re.String(), msg)
-						}
+			o.replay = true
+			for _, m := range o.correlate(msg, fields_of(in.Data)) {
+				o.tested(m)
+			}
+			r := o.eval(msg)
+			if r.Verdict == Matched && o.Rbl_must {
+				ipnet := net.ParseIP(r.Ip)
+				if !o.list.W.Lookup(ipnet) && !o.list.B.Lookup(ipnet) {
+					select {
+					case <-o.gg.Done():
 						return
+					default:
+						if a := o.rbl.Lookup(ipnet, true); len(a) == 0 {
+							r.Verdict = Missed
+						}
 					}
 				}
 			}
-			for _, re := range o.Ignore {
-				if re.MatchString(msg) {
-					o.ignored++
-					if *pignored {
-						j.Infof("ignored: %s\n", re.String())
-					}
-					return
+			switch r.Verdict {
+			case Matched:
+				o.matched++
+				o.matched_u[r.Ip] = true
+				if *pmatched {
+					j.Infof("matched: %s %v\n%v\n", r.Ip, r.By, msg)
+				}
+			case Ignored:
+				o.ignored++
+				if *pignored {
+					j.Infof("ignored: %s\n", r.By)
+				}
+			default:
+				if *pmissed {
+					j.Infof("missed: %s\n", msg)
 				}
-			}
-			if *pmissed {
-				j.Infof("missed: %s\n", msg)
 			}
 		}
 	}
 }
 
+// tested counts a fired Correlate sequence of -test
+func (o *Filter) tested(m *match) {
+	o.fired++
+	o.matched_u[m.r.Ip] = true
+	if *pmatched {
+		j.Infof("correlated: %s %v\n%v\n", m.r.Ip, m.r.By, m.msg)
+	}
+}
+
 func (o *Filter) UnmarshalTOML(data interface{}) error {
 	m := data.(map[string]interface{})
 	var ok bool
+	// builtin = 'sshd' decodes the built-in filter first, the other keys of
+	// the toml replace its values
+	for k, v := range m {
+		if strings.ToLower(k) != "builtin" {
+			continue
+		}
+		if 0 < len(o.Builtin) {
+			return fmt.Errorf("builtin in builtin: %v", o.Builtin)
+		}
+		if o.Builtin, ok = v.(string); !ok {
+			return fmt.Errorf("builtin is not a string: %v", v)
+		}
+		b, err := Builtin(o.Builtin)
+		if err != nil {
+			return err
+		}
+		if _, err = toml.Decode(string(b), o); err != nil {
+			return fmt.Errorf("builtin %v: %w", o.Builtin, err)
+		}
+	}
 	for k, v := range m {
 		switch strings.ToLower(k) {
+		case "builtin":
 		case "enabled":
 			if o.Enabled, ok = v.(bool); !ok {
 				return fmt.Errorf("missing enabled: %v", v)
@@ -247,6 +1502,14 @@ func (o *Filter) UnmarshalTOML(data interface{}) error {
 			if o.Action, ok = v.(string); !ok {
 				return fmt.Errorf("missing action: %v", v)
 			}
+			if o.topic, ok = Actions[o.Action]; !ok {
+				a := make([]string, 0, len(Actions))
+				for k := range Actions {
+					a = append(a, k)
+				}
+				sort.Strings(a)
+				return fmt.Errorf("unknown action: %v, use: %v", o.Action, strings.Join(a, `, `))
+			}
 		case "syslog_identifier":
 			switch t := v.(type) {
 			case string:
@@ -263,12 +1526,79 @@ func (o *Filter) UnmarshalTOML(data interface{}) error {
 			default:
 				return fmt.Errorf("unknown syslog_identifier: %T %v", t, t)
 			}
+		case "journal":
+			// { _SYSTEMD_UNIT = 'ssh.service', PRIORITY = [3, 4] }
+			t, ok := v.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("journal is not a table: %v", v)
+			}
+			o.Journal = make(map[string][]string, len(t))
+			for field, fv := range t {
+				if !field_re.MatchString(field) {
+					return fmt.Errorf("journal: invalid field name: %v", field)
+				}
+				a, ok := fv.([]interface{})
+				if !ok {
+					a = []interface{}{fv}
+				}
+				for _, iv := range a {
+					switch t := iv.(type) {
+					case string:
+						o.Journal[field] = append(o.Journal[field], t)
+					case int64:
+						o.Journal[field] = append(o.Journal[field], strconv.FormatInt(t, 10))
+					default:
+						return fmt.Errorf("journal: %v: not a string: %T %v", field, iv, iv)
+					}
+				}
+			}
+		case "source":
+			t, ok := v.(string)
+			if !ok {
+				return fmt.Errorf("unknown source: %T %v", v, v)
+			}
+			if _, _, err := source.Parse(t); err != nil {
+				return err
+			}
+			o.Source = t
 		case "rbl_use":
 			if t, ok := v.(bool); ok {
 				o.Rbl_use = t
 			} else {
 				return fmt.Errorf("unknown rbl_use: %T %v", t, t)
 			}
+		case "ban_duration":
+			t, ok := v.(string)
+			if !ok {
+				return fmt.Errorf("unknown ban_duration: %T %v", v, v)
+			}
+			d, err := time.ParseDuration(t)
+			if err != nil {
+				return fmt.Errorf("ban_duration: %v", err)
+			}
+			if d <= 0 {
+				return fmt.Errorf("ban_duration must be > 0: %v", t)
+			}
+			o.Ban_duration = d
+		case "maxretry":
+			t, ok := v.(int64)
+			if !ok || t < 1 {
+				return fmt.Errorf("maxretry must be an integer > 0: %v", v)
+			}
+			o.Maxretry = int(t)
+		case "findtime":
+			t, ok := v.(string)
+			if !ok {
+				return fmt.Errorf("unknown findtime: %T %v", v, v)
+			}
+			d, err := time.ParseDuration(t)
+			if err != nil {
+				return fmt.Errorf("findtime: %v", err)
+			}
+			if d <= 0 {
+				return fmt.Errorf("findtime must be > 0: %v", t)
+			}
+			o.Findtime = d
 		case "rbl_must":
 			if t, ok := v.(bool); ok {
 				o.Rbl_must = t
@@ -276,63 +1606,103 @@ func (o *Filter) UnmarshalTOML(data interface{}) error {
 				return fmt.Errorf("unknown rbl_must: %T %v", t, t)
 			}
 		case "re":
+			// A string or an inline table: { re = '', ignore = [] }
 			a, ok := v.([]interface{})
 			if !ok {
 				return fmt.Errorf("not an array: %v", k)
 			}
-			o.Re = make([]*regexp.Regexp, 0, len(a))
+			o.Rule = make([]*Rule, 0, len(a))
 			for i, rev := range a {
+				rule := &Rule{Ignore: make([]*regexp.Regexp, 0)}
+				switch t := rev.(type) {
+				case string:
+					rev = t
+				case map[string]interface{}:
+					for rk, rv := range t {
+						switch rk {
+						case "re":
+							rev = rv
+						case "ignore":
+							var err error
+							if rule.Ignore, err = regexps(fmt.Sprintf("re[%v].ignore", i), rv); err != nil {
+								return err
+							}
+						default:
+							return fmt.Errorf("re[%v]: unknown key: %v", i, rk)
+						}
+					}
+				}
 				s, ok := rev.(string)
 				if !ok {
 					return fmt.Errorf("re[%v] is not a string: %v", i, rev)
 				}
-				if !strings.Contains(s, ipv4var) {
-					return fmt.Errorf("missing in re: %v %s", ipv4var, s)
-				}
-				t, err := template.New(``).Parse(s)
+				re, err := o.compile(s)
 				if err != nil {
-					return fmt.Errorf("cannot make template: %v, %v", err, s)
-				}
-				var reb bytes.Buffer
-				if err := t.Execute(&reb, map[string]string{"Ipv4": ipv4re}); err != nil {
-					j.Err(err)
 					return err
 				}
-				if re, err := regexp.Compile(reb.String()); err == nil {
-					o.Re = append(o.Re, re)
-				} else {
-					return fmt.Errorf("%v: %v", err, reb.String())
-				}
+				rule.Re, rule.src = re, s
+				rule.literals()
+				o.Rule = append(o.Rule, rule)
 			}
 		case "ignore":
+			var err error
+			if o.Ignore, err = regexps(k, v); err != nil {
+				return err
+			}
+		case "ignore_ip":
 			a, ok := v.([]interface{})
 			if !ok {
 				return fmt.Errorf("not an array: %v", k)
 			}
-			o.Ignore = make([]*regexp.Regexp, 0, len(a))
-			for i, rev := range a {
-				s, ok := rev.(string)
+			// Replaces the builtin ignore_ip like every other key
+			o.Ignore_ip = list.New().W
+			for i, iv := range a {
+				s, ok := iv.(string)
 				if !ok {
-					return fmt.Errorf("re[%v] is not a string: %v", i, rev)
+					return fmt.Errorf("ignore_ip[%v] is not a string: %v", i, iv)
 				}
-				if ignore, err := regexp.Compile(s); err == nil {
-					o.Ignore = append(o.Ignore, ignore)
-				} else {
-					return fmt.Errorf("%v: %v", err, s)
+				if err := o.Ignore_ip.Add(s); err != nil {
+					return fmt.Errorf("ignore_ip[%v]: %v", i, err)
+				}
+			}
+		case "correlate":
+			// [[correlate]] tables or an array of inline tables
+			var a []map[string]interface{}
+			switch t := v.(type) {
+			case []map[string]interface{}:
+				a = t
+			case []interface{}:
+				for i, cv := range t {
+					m, ok := cv.(map[string]interface{})
+					if !ok {
+						return fmt.Errorf("correlate[%v] is not a table: %v", i, cv)
+					}
+					a = append(a, m)
 				}
+			default:
+				return fmt.Errorf("not an array of tables: %v", k)
+			}
+			o.Correlate = make([]*Correlate, 0, len(a))
+			for i, m := range a {
+				c, err := o.new_correlate(m)
+				if err != nil {
+					return fmt.Errorf("correlate[%v]: %v", i, err)
+				}
+				o.Correlate = append(o.Correlate, c)
 			}
 		case "testdata":
 			a, ok := v.([]interface{})
 			if !ok {
 				return fmt.Errorf("not an array: %v", k)
 			}
-			o.testdata = make([]string, 0, len(a))
+			// A string or { line = '', expect = 'matched|ignored|missed', ip = '', fields = {} }
+			o.testdata = make([]*Testdata, 0, len(a))
 			for i, dv := range a {
-				s, ok := dv.(string)
-				if !ok {
-					return fmt.Errorf("testdata[%v] is not a string: %v", i, dv)
+				t, err := testdata(dv)
+				if err != nil {
+					return fmt.Errorf("testdata[%v]: %v", i, err)
 				}
-				o.testdata = append(o.testdata, s)
+				o.testdata = append(o.testdata, t)
 			}
 		default:
 			e := fmt.Errorf("unknown key: %v, v: %#v", k, v)
@@ -342,3 +1712,299 @@ func (o *Filter) UnmarshalTOML(data interface{}) error {
 	}
 	return nil
 }
+
+// compile expands the Vars and user vars in s. The re must have an IP group.
+func (o *Filter) compile(s string) (*regexp.Regexp, error) {
+	re, err := o.expand(s)
+	if err != nil {
+		return nil, err
+	}
+	if has_ip(re) {
+		return re, nil
+	}
+	return nil, fmt.Errorf("missing in re: {{.Ip}}, {{.Ipv4}} or {{.Ipv6}}: %s", s)
+}
+
+// expand compiles s with the Vars and user vars
+func (o *Filter) expand(s string) (*regexp.Regexp, error) {
+	vars := o.vars
+	if vars == nil {
+		vars = Vars
+	}
+	ex, err := Expand(s, vars)
+	if err != nil {
+		return nil, err
+	}
+	re, err := regexp.Compile(ex)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", err, ex)
+	}
+	return re, nil
+}
+
+func has_ip(re *regexp.Regexp) bool {
+	for _, name := range re.SubexpNames() {
+		if ip_groups[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// pattern compiles a Correlate pattern, the IP group is optional
+func (o *Filter) pattern(k string, v interface{}) (*Rule, error) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("%v is not a string: %v", k, v)
+	}
+	re, err := o.expand(s)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", k, err)
+	}
+	r := &Rule{Re: re, src: s}
+	r.literals()
+	return r, nil
+}
+
+// new_correlate decodes a [[correlate]] table:
+//
+//	start = '^connect from {{.Host}}\[{{.Ip}}\]$'
+//	follow = ['^lost connection after AUTH ', { re = '...', count = 3 }]
+//	unless = ['^disconnect from ']
+//	key = 'SYSLOG_PID'
+//	window = '1m'
+//	fire = 'complete|timeout'
+func (o *Filter) new_correlate(m map[string]interface{}) (*Correlate, error) {
+	c := &Correlate{open: map[string]*sequence{}}
+	var err error
+	for k, v := range m {
+		switch k {
+		case "start":
+			if c.Start, err = o.pattern(k, v); err != nil {
+				return nil, err
+			}
+		case "follow":
+			a, ok := v.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("not an array: %v", k)
+			}
+			for i, fv := range a {
+				st := &Step{Count: 1}
+				if t, ok := fv.(map[string]interface{}); ok {
+					fv = nil
+					for fk, x := range t {
+						switch fk {
+						case "re":
+							fv = x
+						case "count":
+							n, ok := x.(int64)
+							if !ok || n < 1 {
+								return nil, fmt.Errorf("follow[%v].count must be an integer > 0: %v", i, x)
+							}
+							st.Count = int(n)
+						default:
+							return nil, fmt.Errorf("follow[%v]: unknown key: %v", i, fk)
+						}
+					}
+				}
+				r, err := o.pattern(fmt.Sprintf("follow[%v]", i), fv)
+				if err != nil {
+					return nil, err
+				}
+				st.Rule = *r
+				c.Follow = append(c.Follow, st)
+			}
+		case "unless":
+			a, ok := v.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("not an array: %v", k)
+			}
+			for i, uv := range a {
+				r, err := o.pattern(fmt.Sprintf("unless[%v]", i), uv)
+				if err != nil {
+					return nil, err
+				}
+				c.Unless = append(c.Unless, r)
+			}
+		case "key":
+			ok := false
+			if c.Key, ok = v.(string); !ok || len(c.Key) == 0 {
+				return nil, fmt.Errorf("key is not a name: %v", v)
+			}
+			c.field = field_re.MatchString(c.Key)
+		case "window":
+			t, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("unknown window: %T %v", v, v)
+			}
+			if c.Window, err = time.ParseDuration(t); err != nil {
+				return nil, fmt.Errorf("window: %v", err)
+			}
+			if c.Window <= 0 {
+				return nil, fmt.Errorf("window must be > 0: %v", t)
+			}
+		case "fire":
+			switch v {
+			case "complete":
+				c.Timeout = false
+			case "timeout":
+				c.Timeout = true
+			default:
+				return nil, fmt.Errorf("unknown fire: %v, use: complete, timeout", v)
+			}
+		default:
+			return nil, fmt.Errorf("unknown key: %v", k)
+		}
+	}
+	switch {
+	case c.Start == nil:
+		return nil, errors.New("missing start")
+	case len(c.Key) == 0:
+		return nil, errors.New("missing key")
+	case c.Window == 0:
+		return nil, errors.New("missing window")
+	case !c.Timeout && len(c.Follow) == 0:
+		return nil, errors.New("fire = 'complete' needs follow")
+	case c.Timeout && len(c.Follow) == 0 && len(c.Unless) == 0:
+		return nil, errors.New("fire = 'timeout' needs follow or unless")
+	}
+	ip := has_ip(c.Start.Re)
+	for _, st := range c.Follow {
+		ip = ip || has_ip(st.Re)
+	}
+	if !ip {
+		return nil, errors.New("missing in start or follow: {{.Ip}}, {{.Ipv4}} or {{.Ipv6}}")
+	}
+	if c.field {
+		return c, nil
+	}
+	// Every line of a sequence captures the key
+	if c.Start.Re.SubexpIndex(c.Key) < 0 {
+		return nil, fmt.Errorf("start: missing key group: %v", c.Key)
+	}
+	for i, st := range c.Follow {
+		if st.Re.SubexpIndex(c.Key) < 0 {
+			return nil, fmt.Errorf("follow[%v]: missing key group: %v", i, c.Key)
+		}
+	}
+	for i, r := range c.Unless {
+		if r.Re.SubexpIndex(c.Key) < 0 {
+			return nil, fmt.Errorf("unless[%v]: missing key group: %v", i, c.Key)
+		}
+	}
+	return c, nil
+}
+
+// Expand returns the re template s with vars, i.e. Vars
+func Expand(s string, vars map[string]string) (string, error) {
+	t, err := template.New(``).Option(`missingkey=error`).Parse(s)
+	if err != nil {
+		return ``, fmt.Errorf("cannot make template: %v, %v", err, s)
+	}
+	var reb bytes.Buffer
+	if err := t.Execute(&reb, vars); err != nil {
+		return ``, err
+	}
+	return reb.String(), nil
+}
+
+// Load_vars returns Vars and the user vars of the toml file fn. A missing
+// file is not an error.
+func Load_vars(fn string) (map[string]string, error) {
+	r := make(map[string]string, len(Vars))
+	for k, v := range Vars {
+		r[k] = v
+	}
+	user := map[string]string{}
+	if _, err := toml.DecodeFile(fn, &user); err != nil {
+		if os.IsNotExist(err) {
+			return r, nil
+		}
+		return nil, fmt.Errorf("%v: %v", fn, err)
+	}
+	for k, v := range user {
+		if _, ok := Vars[k]; ok {
+			return nil, fmt.Errorf("%v: %v is a built-in variable", fn, k)
+		}
+		if _, err := regexp.Compile(v); err != nil {
+			return nil, fmt.Errorf("%v: %v: %v", fn, k, err)
+		}
+		r[k] = v
+	}
+	return r, nil
+}
+
+func testdata(v interface{}) (*Testdata, error) {
+	switch t := v.(type) {
+	case string:
+		return &Testdata{Line: t}, nil
+	case map[string]interface{}:
+		r := &Testdata{}
+		for k, v := range t {
+			switch k {
+			case "fields":
+				m, ok := v.(map[string]interface{})
+				if !ok {
+					return nil, fmt.Errorf("fields is not a table: %v", v)
+				}
+				r.Fields = make(map[string]string, len(m))
+				for fk, fv := range m {
+					s, ok := fv.(string)
+					if !ok {
+						return nil, fmt.Errorf("fields: %v is not a string: %v", fk, fv)
+					}
+					r.Fields[fk] = s
+				}
+				continue
+			}
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("%v is not a string: %v", k, v)
+			}
+			switch k {
+			case "line":
+				r.Line = s
+			case "expect":
+				switch s {
+				case Matched, Ignored, Missed:
+					r.Verdict = s
+				default:
+					return nil, fmt.Errorf("unknown expect: %v, use: %v, %v, %v", s, Matched, Ignored, Missed)
+				}
+			case "ip":
+				r.Ip = s
+			default:
+				return nil, fmt.Errorf("unknown key: %v", k)
+			}
+		}
+		if len(r.Line) == 0 {
+			return nil, fmt.Errorf("missing line")
+		}
+		if len(r.Verdict) == 0 && (0 < len(r.Ip) || 0 < len(r.Fields)) {
+			r.Verdict = Matched
+		}
+		return r, nil
+	}
+	return nil, fmt.Errorf("not a string or table: %v", v)
+}
+
+// regexps compiles an array of strings
+func regexps(k string, v interface{}) ([]*regexp.Regexp, error) {
+	a, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("not an array: %v", k)
+	}
+	r := make([]*regexp.Regexp, 0, len(a))
+	for i, rev := range a {
+		s, ok := rev.(string)
+		if !ok {
+			return nil, fmt.Errorf("%v[%v] is not a string: %v", k, i, rev)
+		}
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", err, s)
+		}
+		r = append(r, re)
+	}
+	return r, nil
+}
@@ -0,0 +1,552 @@
+package filter
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp/syntax"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/aletheia7/banip/list"
+	"github.com/aletheia7/banip/source"
+	"github.com/aletheia7/mbus"
+)
+
+func Test_retry(t *testing.T) {
+	o := &Filter{Maxretry: 3, Findtime: time.Minute, hits: map[string][]hit{}}
+	now := time.Now()
+	if _, ok := o.retry(`192.0.2.1`, "1", now); ok {
+		t.Fatal("1 of 3")
+	}
+	if _, ok := o.retry(`192.0.2.1`, "2", now.Add(time.Second*50)); ok {
+		t.Fatal("2 of 3")
+	}
+	// first one slides out
+	if _, ok := o.retry(`192.0.2.1`, "3", now.Add(time.Second*70)); ok {
+		t.Fatal("first match is outside findtime")
+	}
+	m, ok := o.retry(`192.0.2.1`, "4", now.Add(time.Second*80))
+	if !ok || m != "2\n3\n4" {
+		t.Fatalf("retry: %q %v", m, ok)
+	}
+	if len(o.hits) != 0 {
+		t.Fatalf("hits: %v", o.hits)
+	}
+}
+
+func Test_eval(t *testing.T) {
+	o := &Filter{Rule: []*Rule{}, Ignore_ip: list.New().W}
+	if _, err := toml.Decode(`
+re = [
+	{ re = 'login failed: {{.Ipv4}}', ignore = ['user=test$'] },
+	'failed: {{.Ipv4}}',
+]
+ignore = ['^debug']
+ignore_ip = ['10.0.0.0/8']
+`, o); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		msg     string
+		verdict string
+		rule    int
+	}{
+		{`debug login failed: 192.0.2.1`, Ignored, -1},
+		{`login failed: 192.0.2.1 user=test`, Ignored, 0},
+		{`login failed: 192.0.2.1 user=x`, Matched, 0},
+		{`auth failed: 192.0.2.1`, Matched, 1},
+		{`login failed: 10.1.2.3 user=x`, Ignored, 0},
+		{`ok: 192.0.2.1`, Missed, -1},
+	} {
+		if r := o.eval(tc.msg); r.Verdict != tc.verdict || r.Rule != tc.rule {
+			t.Errorf("%v: %+v, expected: %v %v", tc.msg, r, tc.verdict, tc.rule)
+		}
+	}
+}
+
+func Test_vars(t *testing.T) {
+	o := &Filter{Rule: []*Rule{}, Ignore_ip: list.New().W}
+	if _, err := toml.Decode(`re = ['from {{.Host}}\[{{.Ip}}\]:{{.Port}} user={{.User}}$']`, o); err != nil {
+		t.Fatal(err)
+	}
+	r := o.eval(`from mx.example.com[2001:db8::25]:587 user=bob`)
+	if r.Verdict != Matched || r.Ip != `2001:db8::25` {
+		t.Fatalf("%+v", r)
+	}
+	if r.Fields[`host`] != `mx.example.com` || r.Fields[`port`] != `587` || r.Fields[`user`] != `bob` || len(r.Fields) != 3 {
+		t.Fatalf("fields: %v", r.Fields)
+	}
+	if _, err := toml.Decode(`re = ['from {{.Host}}']`, o); err == nil {
+		t.Error("expected missing IP error")
+	}
+	if _, err := toml.Decode(`re = ['{{.Ip}} {{.Nope}}']`, o); err == nil {
+		t.Error("expected unknown variable error")
+	}
+}
+
+func Test_journal(t *testing.T) {
+	o := &Filter{Source: source.Journal}
+	if _, err := toml.Decode(`
+syslog_identifier = 'sshd'
+journal = { _SYSTEMD_UNIT = 'ssh.service', PRIORITY = [3, 4] }
+`, o); err != nil {
+		t.Fatal(err)
+	}
+	if s := strings.Join(o.Journal_match(), ` `); s != `SYSLOG_IDENTIFIER=sshd PRIORITY=3 PRIORITY=4 _SYSTEMD_UNIT=ssh.service` {
+		t.Fatal(s)
+	}
+	for _, tc := range []struct {
+		fields map[string]string
+		expect bool
+	}{
+		{map[string]string{`_SYSTEMD_UNIT`: `ssh.service`, `PRIORITY`: `4`}, true},
+		{map[string]string{`_SYSTEMD_UNIT`: `ssh.service`, `PRIORITY`: `6`}, false},
+		{map[string]string{`PRIORITY`: `3`}, false},
+	} {
+		if _, ok := o.line(&Line{Fields: tc.fields}); ok != tc.expect {
+			t.Errorf("%v: %v", tc.fields, ok)
+		}
+	}
+	if _, err := toml.Decode(`journal = { _comm = 'x' }`, o); err == nil {
+		t.Error("expected field name error")
+	}
+}
+
+func Test_literal(t *testing.T) {
+	for _, tc := range []struct {
+		re, expect, prefix string
+	}{
+		{`^connect from \S+\[(\d+)\]$`, `connect from `, `connect from `},
+		{`^lost connection after AUTH from unknown\[\d+\]$`, `lost connection after AUTH from unknown[`, `lost connection after AUTH from unknown[`},
+		{`(?i)failed password`, ``, ``},
+		{`(a|b)cd+ef`, `ef`, ``},
+		{`x(?:failure; )+`, `failure; `, ``},
+		{`^\d+ x`, ` x`, ``},
+	} {
+		re, err := syntax.Parse(tc.re, syntax.Perl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := literal(re.Simplify()); s != tc.expect {
+			t.Errorf("%v: %q, expected: %q", tc.re, s, tc.expect)
+		}
+		if s := prefix(re.Simplify()); s != tc.prefix {
+			t.Errorf("%v: prefix: %q, expected: %q", tc.re, s, tc.prefix)
+		}
+	}
+}
+
+// corpus returns the filters of ../toml and the builtin filters by topic and
+// the lines of testdata/corpus.log: <tag>\t<message>, and of the builtin
+// testdata. Filters without a syslog_identifier are on T_any.
+func corpus(t testing.TB) (*Dispatcher, []*mbus.Msg) {
+	d := &Dispatcher{f: map[string][]*Filter{}}
+	lines := []*mbus.Msg{}
+	add := func(name, text string) {
+		o := &Filter{Name: name, Source: source.Journal, Rule: []*Rule{}, Ignore_ip: list.New().W}
+		if _, err := toml.Decode(text, o); err != nil {
+			t.Fatal(name, err)
+		}
+		topics := o.Tag
+		if len(topics) == 0 {
+			topics = []string{T_any}
+		}
+		for _, tag := range topics {
+			d.f[tag] = append(d.f[tag], o)
+		}
+		for _, td := range o.testdata {
+			lines = append(lines, mbus.New_msg(topics[0], &Line{Msg: td.Line}))
+		}
+	}
+	a, _ := filepath.Glob(`../toml/*.toml`)
+	for _, fn := range a {
+		if filepath.Base(fn) == Vars_file {
+			continue
+		}
+		b, err := os.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		add(filepath.Base(fn), string(b))
+	}
+	for _, name := range Builtins() {
+		b, err := Builtin(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		add(name, string(b))
+	}
+	b, err := os.ReadFile(`testdata/corpus.log`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		f := strings.SplitN(s, "\t", 2)
+		lines = append(lines, mbus.New_msg(f[0], &Line{Msg: f[1]}))
+	}
+	reindex(d)
+	return d, lines
+}
+
+// reindex makes the index of each topic
+func reindex(d *Dispatcher) {
+	d.idx = map[string]*index{}
+	for t, a := range d.f {
+		d.idx[t] = new_index(a)
+	}
+}
+
+// no_prefilter clears the rule prefixes and literals
+func no_prefilter(d *Dispatcher) {
+	for _, a := range d.f {
+		for _, f := range a {
+			for _, rule := range f.Rule {
+				rule.prefix, rule.lit = ``, ``
+			}
+		}
+	}
+	reindex(d)
+}
+
+func Test_automaton(t *testing.T) {
+	lits := []string{`he`, `she`, `his`, `hers`, `from `, `rom`, `x`}
+	ac := new_automaton(lits)
+	found := make([]bool, len(lits))
+	for _, s := range []string{``, `ushers`, `this`, `hhis from x`, `romp`, `fro`, `HE`} {
+		ac.scan(s, found)
+		for id, lit := range lits {
+			if found[id] != strings.Contains(s, lit) {
+				t.Errorf("%q: %q: %v", s, lit, found[id])
+			}
+		}
+	}
+	new_automaton(nil).scan(`x`, nil)
+}
+
+// The prefilter does not change a match, with and without automata
+func Test_dispatch(t *testing.T) {
+	defer func(n int) { min_scan = n }(min_scan)
+	for _, min_scan = range []int{min_scan, 1} {
+		d, lines := corpus(t)
+		ref, _ := corpus(t)
+		no_prefilter(ref)
+		scans := 0
+		for _, x := range d.idx {
+			if x.ac != nil {
+				scans++
+			}
+		}
+		if min_scan == 1 && scans == 0 {
+			t.Error("no automaton")
+		}
+		ct := 0
+		for _, in := range lines {
+			var got, expect []string
+			d.dispatch(in.Topic, in.Data, func(f *Filter, m *match) {
+				got = append(got, f.Name+` `+m.r.Ip)
+			})
+			ref.dispatch(in.Topic, in.Data, func(f *Filter, m *match) {
+				expect = append(expect, f.Name+` `+m.r.Ip)
+			})
+			if strings.Join(got, `,`) != strings.Join(expect, `,`) {
+				t.Errorf("min_scan %v: %v: %v, expected: %v", min_scan, in.Data.(*Line).Msg, got, expect)
+			}
+			ct += len(got)
+		}
+		if ct == 0 {
+			t.Error("no matches")
+		}
+	}
+}
+
+// A filter stalled in an RBL lookup drops matches, the Dispatcher does not block
+func Test_send(t *testing.T) {
+	d := &Dispatcher{}
+	f := &Filter{Name: `stalled`, c: make(chan *mbus.Msg, 1)}
+	for i := 0; i < 3; i++ {
+		d.send(f, &match{msg: `line`})
+	}
+	if len(f.c) != 1 || f.dropped != 2 {
+		t.Errorf("queued: %v, dropped: %v", len(f.c), f.dropped)
+	}
+}
+
+// The filters of ../toml and all builtin filters over their testdata and
+// testdata/corpus.log
+func Benchmark_dispatch(b *testing.B) {
+	d, lines := corpus(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, in := range lines {
+			d.dispatch(in.Topic, in.Data, func(*Filter, *match) {})
+		}
+	}
+}
+
+// Every topic with unanchored literals is scanned by an automaton
+func Benchmark_dispatch_scan(b *testing.B) {
+	defer func(n int) { min_scan = n }(min_scan)
+	min_scan = 1
+	Benchmark_dispatch(b)
+}
+
+func Benchmark_dispatch_no_prefilter(b *testing.B) {
+	d, lines := corpus(b)
+	no_prefilter(d)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, in := range lines {
+			d.dispatch(in.Topic, in.Data, func(*Filter, *match) {})
+		}
+	}
+}
+
+// One scan against strings.Contains of each literal, see min_scan
+func Benchmark_scan(b *testing.B) {
+	line := `warning: hostname client.example.com does not resolve to address 192.0.2.20: Name or service not known`
+	for _, n := range []int{4, 8, 32} {
+		lits := make([]string, n)
+		for i := range lits {
+			lits[i] = fmt.Sprintf("literal %v:", i)
+		}
+		ac := new_automaton(lits)
+		found := make([]bool, n)
+		b.Run(fmt.Sprint(`automaton-`, n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				ac.scan(line, found)
+			}
+		})
+		b.Run(fmt.Sprint(`contains-`, n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for id, s := range lits {
+					found[id] = strings.Contains(line, s)
+				}
+			}
+		})
+	}
+}
+
+func Test_testdata(t *testing.T) {
+	o := &Filter{Name: `t`, Rule: []*Rule{}, Ignore_ip: list.New().W}
+	if _, err := toml.Decode(`
+re = ['user={{.User}} from {{.Ip}}']
+ignore = ['test']
+testdata = [
+	'user=a from 192.0.2.1',
+	{ line = 'user=a from 192.0.2.1', ip = '192.0.2.1', fields = { user = 'a' } },
+	{ line = 'user=test from 192.0.2.1', expect = 'ignored' },
+	{ line = 'nothing', expect = 'missed' },
+	{ line = 'user=b from 192.0.2.2', ip = '192.0.2.9' },
+	{ line = 'user=b from 192.0.2.2', fields = { user = 'c' } },
+	{ line = 'nothing', expect = 'matched' },
+]
+`, o); err != nil {
+		t.Fatal(err)
+	}
+	r := o.Testdata()
+	if r.Total != 7 || r.Matched != 4 || r.Ignored != 1 || r.Missed != 2 || r.Failed != 3 {
+		t.Fatalf("%+v", r)
+	}
+	for i, expect := range []int{0, 0, 0, 0, 1, 1, 1} {
+		if len(r.Results[i].Err) != expect {
+			t.Errorf("%v: %v", r.Results[i].Line, r.Results[i].Err)
+		}
+	}
+	if _, err := toml.Decode(`testdata = [{ line = 'x', expect = 'banned' }]`, o); err == nil {
+		t.Error("expected unknown expect error")
+	}
+}
+
+func Test_lint(t *testing.T) {
+	dir := t.TempDir()
+	for fn, s := range map[string]string{
+		`a.toml`: `syslog_identifier = 'a'
+re = [
+	'^a .*from {{.Ip}}$',
+	{ re = '^a by {{.User}} from {{.Ip}}', ignore = ['by root'] },
+	'^never {{.Ip}}$',
+]
+testdata = [
+	'a from 192.0.2.1',
+	'a by root from 192.0.2.1',
+	{ line = 'a from 192.0.2.2', expect = 'missed' },
+]
+`,
+		`b.toml`: `syslog_identifier = 'b'
+re = ['^a .*from {{.Ip}}$']
+testdata = ['a from 192.0.2.1']
+`,
+		`c.toml`: "syslog_identifier = 'c'\nre = 'x\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, fn), []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := map[string]bool{}
+	for _, p := range Lint(dir, map[string]bool{`a`: true}) {
+		got[filepath.Base(p.File)+`:`+strconv.Itoa(p.Line)] = true
+		t.Log(p)
+	}
+	for _, s := range []string{`a.toml:4`, `a.toml:5`, `a.toml:10`, `b.toml:1`, `b.toml:2`, `c.toml:2`} {
+		if !got[s] {
+			t.Error("missing:", s)
+		}
+	}
+	if len(got) != 6 {
+		t.Error(got)
+	}
+}
+
+func Test_builtin(t *testing.T) {
+	dir := t.TempDir()
+	names := Builtins()
+	if len(names) == 0 {
+		t.Fatal("no builtins")
+	}
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(dir, name+`.toml`), []byte(`builtin = '`+name+`'`), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, p := range Lint(dir, nil) {
+		if filepath.Base(p.File) != `go-http-tls.toml` || !strings.Contains(p.Msg, `no syslog_identifier`) {
+			t.Error(p)
+		}
+	}
+	fn := filepath.Join(dir, `sshd.toml`)
+	if err := os.WriteFile(fn, []byte("builtin = 'sshd'\nmaxretry = 9\nre = ['^x {{.Ip}}$']\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	o, err := Load(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Builtin != `sshd` || !o.Enabled || o.Maxretry != 9 || len(o.Rule) != 1 || strings.Join(o.Tag, ` `) != `sshd sshd-session` {
+		t.Errorf("%+v", o)
+	}
+	if !o.Ignore_ip.Lookup(net.ParseIP(`127.0.0.1`)) {
+		t.Error("builtin ignore_ip: 127.0.0.1 not ignored")
+	}
+	// ignore_ip replaces the builtin ignore_ip
+	if err = os.WriteFile(fn, []byte("builtin = 'sshd'\nignore_ip = ['192.0.2.0/24']\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if o, err = Load(fn); err != nil {
+		t.Fatal(err)
+	}
+	if o.Ignore_ip.Lookup(net.ParseIP(`127.0.0.1`)) || !o.Ignore_ip.Lookup(net.ParseIP(`192.0.2.1`)) {
+		t.Error("ignore_ip not replaced")
+	}
+	if err = os.WriteFile(fn, []byte(`builtin = 'nope'`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Load(fn); err == nil {
+		t.Error("expected unknown builtin")
+	}
+}
+
+func Test_correlate(t *testing.T) {
+	o := &Filter{Name: `t`, Tag: []string{`a`}, Rule: []*Rule{}, Ignore_ip: list.New().W}
+	if _, err := toml.Decode(`
+[[correlate]]
+start = '^connect from {{.Host}}\[{{.Ip}}\]$'
+follow = ['^lost connection after AUTH from ']
+unless = ['sasl_username=']
+key = 'SYSLOG_PID'
+window = '1m'
+
+[[correlate]]
+start = '^Failed publickey for {{.User}} from {{.Ip}} port'
+follow = [{ re = '^Failed publickey for ', count = 2 }, '^Connection closed by authenticating user ']
+key = 'SYSLOG_PID'
+window = '1m'
+
+[[correlate]]
+start = '^CONNECT from \[{{.Ip}}\]'
+follow = ['^PASS (?:NEW|OLD) \[{{.Ip}}\]']
+key = 'ip'
+window = '10s'
+fire = 'timeout'
+`, o); err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Now()
+	var got []string
+	line := func(sec int, pid, msg string) {
+		fields := map[string]string{
+			`SYSLOG_PID`:           pid,
+			`__REALTIME_TIMESTAMP`: strconv.FormatInt(t0.Add(time.Duration(sec)*time.Second).UnixMicro(), 10),
+		}
+		for _, m := range o.correlate(msg, fields) {
+			got = append(got, m.r.By+` `+m.r.Ip)
+		}
+	}
+	line(0, `1`, `connect from unknown[192.0.2.1]`)
+	line(1, `2`, `connect from mail.example.com[192.0.2.2]`)
+	line(2, `2`, `A1B2C3D4E5: client=mail.example.com[192.0.2.2], sasl_method=PLAIN, sasl_username=bob`)
+	line(3, `2`, `lost connection after AUTH from mail.example.com[192.0.2.2]`)
+	line(4, `1`, `lost connection after AUTH from unknown[192.0.2.1]`)
+	line(5, `3`, `connect from unknown[192.0.2.3]`)
+	line(70, `3`, `lost connection after AUTH from unknown[192.0.2.3]`)
+	// pid 40: one key short, pid 41: three failed keys
+	for i, msg := range []string{
+		`Failed publickey for root from 192.0.2.4 port 1 ssh2`,
+		`Failed publickey for root from 192.0.2.4 port 1 ssh2`,
+		`Connection closed by authenticating user root 192.0.2.4 port 1 [preauth]`,
+		`Failed publickey for root from 192.0.2.4 port 1 ssh2`,
+		`Failed publickey for root from 192.0.2.4 port 1 ssh2`,
+		`Failed publickey for root from 192.0.2.4 port 1 ssh2`,
+		`Connection closed by authenticating user root 192.0.2.4 port 1 [preauth]`,
+	} {
+		line(100+i, `4`+strconv.Itoa((i+1)/4), msg)
+	}
+	line(200, `5`, `CONNECT from [192.0.2.5]:1 to [192.0.2.100]:25`)
+	line(201, `6`, `CONNECT from [192.0.2.6]:1 to [192.0.2.100]:25`)
+	line(202, `6`, `PASS NEW [192.0.2.6]:1`)
+	for _, m := range o.expire(t0.Add(time.Second * 211)) {
+		got = append(got, m.r.By+` `+m.r.Ip)
+	}
+	if s := strings.Join(got, `, `); s != `correlate[0] 192.0.2.1, correlate[1] 192.0.2.4, correlate[2] 192.0.2.5` {
+		t.Error(s)
+	}
+	if !o.may_correlate(`PASS OLD [192.0.2.7]:1`) || o.may_correlate(`PASS OLD 192.0.2.7`) {
+		t.Error("may_correlate")
+	}
+	for _, s := range []string{
+		"[[correlate]]\nstart = '^{{.Ip}}'\nkey = 'ip'\nwindow = '1m'\n",
+		"[[correlate]]\nstart = '^{{.Ip}}'\nfollow = ['^x']\nkey = 'ip'\nwindow = '1m'\n",
+		"[[correlate]]\nstart = '^x'\nfollow = ['^y']\nkey = 'PID'\nwindow = '1m'\n",
+		"[[correlate]]\nstart = '^{{.Ip}}'\nfollow = ['^y']\nkey = 'PID'\n",
+	} {
+		if _, err := toml.Decode(s, &Filter{Ignore_ip: list.New().W}); err == nil {
+			t.Error("expected an error:", s)
+		}
+	}
+}
+
+func Test_explain(t *testing.T) {
+	o := &Filter{Name: `t`, Tag: []string{`a`}, Rule: []*Rule{}, Ignore_ip: list.New().W}
+	if _, err := toml.Decode(`
+re = ['^x {{.Ip}}$', { re = '^user={{.User}} from {{.Ip}}$', ignore = ['=root '] }]
+`, o); err != nil {
+		t.Fatal(err)
+	}
+	if steps, _, ok := o.Explain(`b`, `user=a from 192.0.2.1`); ok || len(steps) != 1 {
+		t.Error(ok, steps)
+	}
+	steps, r, ok := o.Explain(`a`, `user=root from 192.0.2.1`)
+	if !ok || r.Verdict != Ignored || r.Rule != 1 {
+		t.Error(ok, r)
+	}
+	if len(steps) != 4 || !strings.Contains(steps[2], `fired`) {
+		t.Error(strings.Join(steps, "\n"))
+	}
+	if _, r, _ = o.Explain(``, `user=a from 192.0.2.1`); r.Verdict != Matched || r.Fields[`user`] != `a` {
+		t.Error(r)
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2018 aletheia7. All rights reserved. Use of this source code is
+// governed by a BSD-2-Clause license that can be found in the LICENSE file.
+
+// Package fw is the firewall driver interface. Drivers: nft.Table,
+// ipset.Set (iptables) and file.List (deny list file).
+package fw
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Rule_marker is the comment of banip drop rules
+const Rule_marker = " ☢ ban ☢ "
+
+// Element is a blacklist entry. Ip is an IP or network in CIDR notation.
+// Timeout 0: no timeout.
+type Element struct {
+	Ip      string
+	Timeout time.Duration
+}
+
+type Driver interface {
+	// Add adds or updates elements. Elements with a Timeout are removed by
+	// the driver.
+	Add(e ...Element) error
+	// Remove ignores IPs that are not present
+	Remove(ip ...string) error
+	Flush() error
+	// List returns the present elements. Ip is an IP or network as formatted
+	// by net.IP.String and net.IPNet.String.
+	List() ([]Element, error)
+}
+
+// Refresher is implemented by drivers where Add keeps the Timeout of a present
+// element. Refresh replaces present elements in one batch.
+type Refresher interface {
+	Refresh(e ...Element) error
+}
+
+// Replacer is implemented by drivers that reject overlapping elements, i.e. an
+// IP inside a network. Replace removes rm and adds e in one batch.
+type Replacer interface {
+	Replace(rm []string, e ...Element) error
+}
+
+// Normal_ip returns an IP or network as formatted by net.IP.String and
+// net.IPNet.String. Host networks are returned as an IP, IPv4-mapped
+// addresses as IPv4.
+func Normal_ip(ip string) (s string, is_v4 bool, err error) {
+	if v := net.ParseIP(ip); v != nil {
+		if v4 := v.To4(); v4 != nil {
+			return v4.String(), true, nil
+		}
+		return v.String(), false, nil
+	}
+	_, ipnet, err := net.ParseCIDR(ip)
+	if err != nil {
+		return ``, false, fmt.Errorf("invalid IP %v", ip)
+	}
+	if v4 := ipnet.IP.To4(); v4 != nil {
+		ipnet.IP = v4
+		ipnet.Mask = ipnet.Mask[len(ipnet.Mask)-net.IPv4len:]
+	}
+	if ones, bits := ipnet.Mask.Size(); ones == bits {
+		return ipnet.IP.String(), len(ipnet.IP) == net.IPv4len, nil
+	}
+	return ipnet.String(), len(ipnet.IP) == net.IPv4len, nil
+}
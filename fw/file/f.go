@@ -0,0 +1,138 @@
+// Copyright 2018 aletheia7. All rights reserved. Use of this source code is
+// governed by a BSD-2-Clause license that can be found in the LICENSE file.
+
+// Package file exports the blacklist as a deny list file: one IP or network
+// per line, sorted. The file is replaced atomically on each change, for
+// consumers like a web server or another firewall.
+package file
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aletheia7/banip/fw"
+)
+
+var _ fw.Driver = &List{}
+
+type List struct {
+	Path string
+	mu   sync.Mutex
+	// zero: no timeout
+	exp map[string]time.Time
+}
+
+// New writes an empty deny list at path
+func New(path string) (*List, error) {
+	o := &List{Path: path, exp: map[string]time.Time{}}
+	if err := o.write(time.Now()); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// Add adds or updates elements. Expired elements are left out of the file on
+// the next write.
+func (o *List) Add(e ...fw.Element) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	now := time.Now()
+	for _, el := range e {
+		s, _, err := fw.Normal_ip(el.Ip)
+		if err != nil {
+			return err
+		}
+		if 0 < el.Timeout {
+			o.exp[s] = now.Add(el.Timeout)
+		} else {
+			o.exp[s] = time.Time{}
+		}
+	}
+	return o.write(now)
+}
+
+func (o *List) Remove(ip ...string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, s := range ip {
+		s, _, err := fw.Normal_ip(s)
+		if err != nil {
+			return err
+		}
+		delete(o.exp, s)
+	}
+	return o.write(time.Now())
+}
+
+func (o *List) Flush() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.exp = map[string]time.Time{}
+	return o.write(time.Now())
+}
+
+// List returns the elements with the time remaining. The file is rewritten
+// when elements have expired.
+func (o *List) List() ([]fw.Element, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	now := time.Now()
+	r := make([]fw.Element, 0, len(o.exp))
+	expired := false
+	for s, exp := range o.exp {
+		el := fw.Element{Ip: s}
+		if !exp.IsZero() {
+			if el.Timeout = exp.Sub(now); el.Timeout <= 0 {
+				expired = true
+				continue
+			}
+		}
+		r = append(r, el)
+	}
+	if expired {
+		if err := o.write(now); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// write replaces the file with a temp file and rename. Expired elements are
+// removed.
+func (o *List) write(now time.Time) error {
+	a := make([]string, 0, len(o.exp))
+	for s, exp := range o.exp {
+		if !exp.IsZero() && !now.Before(exp) {
+			delete(o.exp, s)
+			continue
+		}
+		a = append(a, s)
+	}
+	sort.Strings(a)
+	var b bytes.Buffer
+	for _, s := range a {
+		b.WriteString(s)
+		b.WriteByte('\n')
+	}
+	f, err := os.CreateTemp(filepath.Dir(o.Path), `.`+filepath.Base(o.Path)+`.*`)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(b.Bytes()); err == nil {
+		if err = f.Chmod(0644); err == nil {
+			err = f.Sync()
+		}
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), o.Path)
+}
@@ -0,0 +1,53 @@
+package file
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aletheia7/banip/fw"
+)
+
+func Test_list(t *testing.T) {
+	p := filepath.Join(t.TempDir(), `banip.deny`)
+	l, err := New(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Add(
+		fw.Element{Ip: `::ffff:192.0.2.1`},
+		fw.Element{Ip: `2001:db8::/32`, Timeout: time.Hour},
+		fw.Element{Ip: `198.51.100.7/32`},
+		fw.Element{Ip: `203.0.113.0/24`, Timeout: time.Nanosecond},
+	); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	if err := l.Remove(`198.51.100.7`, `192.0.2.99`); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := string(b); s != "192.0.2.1\n2001:db8::/32\n" {
+		t.Fatalf("file: %q", s)
+	}
+	a, err := l.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a) != 2 {
+		t.Fatalf("List: %v", a)
+	}
+	if err := l.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ = os.ReadFile(p); len(b) != 0 {
+		t.Fatalf("file after Flush: %q", b)
+	}
+	if m, _ := filepath.Glob(filepath.Join(filepath.Dir(p), `.*`)); len(m) != 0 {
+		t.Fatalf("temp files: %v", m)
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2018 aletheia7. All rights reserved. Use of this source code is
+// governed by a BSD-2-Clause license that can be found in the LICENSE file.
+
+// Package ipset drops blacklisted IPs with ipset hash:net sets and
+// iptables/ip6tables rules. For hosts without nftables.
+package ipset
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aletheia7/banip/fw"
+)
+
+// Max_timeout is the largest ipset timeout. Longer elements are added
+// without a timeout and removed by banip.
+const Max_timeout = time.Duration(2147483) * time.Second
+
+var _ fw.Driver = &Set{}
+
+// command runs ipset and iptables, replaced in tests
+var command = exec.Command
+
+type Set struct {
+	// Set holds IPv4 addresses, Set6 holds IPv6 addresses
+	Set      string
+	Set6     string
+	Chain    string
+	Iptables string
+}
+
+type option func(*Set)
+
+// iptables command, ip6tables is derived. Default: iptables
+// Example: ipset.Iptables(`iptables-legacy`)
+func Iptables(cmd string) option {
+	return func(o *Set) {
+		o.Iptables = cmd
+	}
+}
+
+// iptables chain of the drop rules. Default: INPUT
+func Chain(chain string) option {
+	return func(o *Set) {
+		o.Chain = chain
+	}
+}
+
+// New makes the sets, IPv6 set: set + "6", and inserts a drop rule for
+// each set at the top of the chain. Existing sets and rules are kept.
+func New(set string, opt ...option) (*Set, error) {
+	o := &Set{Set: set, Set6: set + `6`, Chain: `INPUT`, Iptables: `iptables`}
+	for _, op := range opt {
+		op(o)
+	}
+	for _, t := range []struct {
+		set, family, iptables string
+	}{
+		{o.Set, `inet`, o.Iptables},
+		{o.Set6, `inet6`, strings.Replace(o.Iptables, `iptables`, `ip6tables`, 1)},
+	} {
+		if err := run(nil, `ipset`, `-exist`, `create`, t.set, `hash:net`, `family`, t.family, `timeout`, `0`); err != nil {
+			return nil, err
+		}
+		rule := []string{o.Chain, `-m`, `set`, `--match-set`, t.set, `src`, `-m`, `comment`, `--comment`, fw.Rule_marker, `-j`, `DROP`}
+		if run(nil, t.iptables, append([]string{`-C`}, rule...)...) == nil {
+			continue
+		}
+		if err := run(nil, t.iptables, append([]string{`-I`}, rule...)...); err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+// Add adds or updates elements in one ipset restore
+func (o *Set) Add(e ...fw.Element) error {
+	var b bytes.Buffer
+	for _, el := range e {
+		s, is_v4, err := fw.Normal_ip(el.Ip)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&b, "add %v %v timeout %v\n", o.set(is_v4), s, timeout(el.Timeout))
+	}
+	return o.restore(&b)
+}
+
+// Remove ignores IPs that are not present
+func (o *Set) Remove(ip ...string) error {
+	var b bytes.Buffer
+	for _, s := range ip {
+		s, is_v4, err := fw.Normal_ip(s)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&b, "del %v %v\n", o.set(is_v4), s)
+	}
+	return o.restore(&b)
+}
+
+func (o *Set) Flush() error {
+	for _, set := range []string{o.Set, o.Set6} {
+		if err := run(nil, `ipset`, `flush`, set); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// List returns the set contents. Timeout is the time remaining.
+func (o *Set) List() ([]fw.Element, error) {
+	r := []fw.Element{}
+	for _, set := range []string{o.Set, o.Set6} {
+		cmd := command(`ipset`, `save`, set)
+		b, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", cmd.Args, err)
+		}
+		sc := bufio.NewScanner(bytes.NewReader(b))
+		for sc.Scan() {
+			// add <set> <ip> [timeout <seconds>]
+			f := strings.Fields(sc.Text())
+			if len(f) < 3 || f[0] != `add` {
+				continue
+			}
+			s, _, err := fw.Normal_ip(f[2])
+			if err != nil {
+				return nil, err
+			}
+			el := fw.Element{Ip: s}
+			if len(f) == 5 && f[3] == `timeout` {
+				if n, err := strconv.Atoi(f[4]); err == nil {
+					el.Timeout = time.Duration(n) * time.Second
+				}
+			}
+			r = append(r, el)
+		}
+	}
+	return r, nil
+}
+
+// Delete removes the rules and the sets
+func (o *Set) Delete() error {
+	for _, t := range []struct {
+		set, iptables string
+	}{
+		{o.Set, o.Iptables},
+		{o.Set6, strings.Replace(o.Iptables, `iptables`, `ip6tables`, 1)},
+	} {
+		run(nil, t.iptables, `-D`, o.Chain, `-m`, `set`, `--match-set`, t.set, `src`, `-m`, `comment`, `--comment`, fw.Rule_marker, `-j`, `DROP`)
+		if err := run(nil, `ipset`, `destroy`, t.set); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *Set) set(is_v4 bool) string {
+	if is_v4 {
+		return o.Set
+	}
+	return o.Set6
+}
+
+func (o *Set) restore(b *bytes.Buffer) error {
+	if b.Len() == 0 {
+		return nil
+	}
+	return run(b, `ipset`, `-exist`, `restore`)
+}
+
+// timeout in seconds, rounded up. 0: no timeout.
+func timeout(d time.Duration) int64 {
+	if d <= 0 || Max_timeout < d {
+		return 0
+	}
+	return int64(math.Ceil(d.Seconds()))
+}
+
+func run(stdin *bytes.Buffer, name string, arg ...string) error {
+	cmd := command(name, arg...)
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
+	if b, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %v: %s", cmd.Args, err, bytes.TrimSpace(b))
+	}
+	return nil
+}
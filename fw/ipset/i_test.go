@@ -0,0 +1,119 @@
+package ipset
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aletheia7/banip/fw"
+)
+
+// Test_helper is the stubbed ipset/iptables. It appends the command line and
+// stdin to the $BANIP_IPSET_LOG file.
+func Test_helper(t *testing.T) {
+	log := os.Getenv(`BANIP_IPSET_LOG`)
+	if len(log) == 0 {
+		return
+	}
+	arg := os.Args[len(os.Args)-1:]
+	for i, s := range os.Args {
+		if s == `--` {
+			arg = os.Args[i+1:]
+			break
+		}
+	}
+	f, err := os.OpenFile(log, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		os.Exit(2)
+	}
+	f.WriteString(strings.Join(arg, ` `) + "\n")
+	io.Copy(f, os.Stdin)
+	f.Close()
+	switch strings.Join(arg, ` `) {
+	case `ipset save banip`:
+		os.Stdout.WriteString("create banip hash:net family inet hashsize 1024 maxelem 65536 timeout 0\nadd banip 192.0.2.1 timeout 3599\nadd banip 198.51.100.0/24\n")
+	case `ipset save banip6`:
+		os.Stdout.WriteString("create banip6 hash:net family inet6 hashsize 1024 maxelem 65536 timeout 0\nadd banip6 2001:db8::/32 timeout 60\n")
+	}
+	if 1 < len(arg) && arg[1] == `-C` {
+		// No rule
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func stub(t *testing.T) (log func() string) {
+	p := filepath.Join(t.TempDir(), `log`)
+	command = func(name string, arg ...string) *exec.Cmd {
+		c := exec.Command(os.Args[0], append([]string{`-test.run=Test_helper`, `--`, name}, arg...)...)
+		c.Env = append(os.Environ(), `BANIP_IPSET_LOG=`+p)
+		return c
+	}
+	t.Cleanup(func() { command = exec.Command })
+	return func() string {
+		b, _ := os.ReadFile(p)
+		os.Remove(p)
+		return string(b)
+	}
+}
+
+func Test_set(t *testing.T) {
+	log := stub(t)
+	o, err := New(`banip`, Iptables(`iptables-legacy`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := `ipset -exist create banip hash:net family inet timeout 0
+iptables-legacy -C INPUT -m set --match-set banip src -m comment --comment ` + fw.Rule_marker + ` -j DROP
+iptables-legacy -I INPUT -m set --match-set banip src -m comment --comment ` + fw.Rule_marker + ` -j DROP
+ipset -exist create banip6 hash:net family inet6 timeout 0
+ip6tables-legacy -C INPUT -m set --match-set banip6 src -m comment --comment ` + fw.Rule_marker + ` -j DROP
+ip6tables-legacy -I INPUT -m set --match-set banip6 src -m comment --comment ` + fw.Rule_marker + ` -j DROP
+`
+	if s := log(); s != expect {
+		t.Errorf("New:\n%v\nexpected:\n%v", s, expect)
+	}
+	for _, tc := range []struct {
+		name   string
+		f      func() error
+		expect string
+	}{
+		{`Add`, func() error {
+			return o.Add(fw.Element{Ip: `192.0.2.1`, Timeout: time.Millisecond}, fw.Element{Ip: `::ffff:203.0.113.9/128`}, fw.Element{Ip: `2001:db8::/32`, Timeout: Max_timeout + 1})
+		}, "ipset -exist restore\nadd banip 192.0.2.1 timeout 1\nadd banip 203.0.113.9 timeout 0\nadd banip6 2001:db8::/32 timeout 0\n"},
+		{`Remove`, func() error {
+			return o.Remove(`192.0.2.0/24`, `2001:db8::1`)
+		}, "ipset -exist restore\ndel banip 192.0.2.0/24\ndel banip6 2001:db8::1\n"},
+		{`Remove none`, func() error {
+			return o.Remove()
+		}, ``},
+		{`Flush`, o.Flush, "ipset flush banip\nipset flush banip6\n"},
+	} {
+		if err := tc.f(); err != nil {
+			t.Fatal(tc.name, err)
+		}
+		if s := log(); s != tc.expect {
+			t.Errorf("%v:\n%v\nexpected:\n%v", tc.name, s, tc.expect)
+		}
+	}
+	if err := o.Add(fw.Element{Ip: `x`}); err == nil {
+		t.Error("Add: expected invalid IP error")
+	}
+	a, err := o.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	el := []fw.Element{{Ip: `192.0.2.1`, Timeout: 3599 * time.Second}, {Ip: `198.51.100.0/24`}, {Ip: `2001:db8::/32`, Timeout: time.Minute}}
+	if len(a) != len(el) {
+		t.Fatalf("List: %v, expected: %v", a, el)
+	}
+	for i := range a {
+		if a[i] != el[i] {
+			t.Errorf("List: %v, expected: %v", a[i], el[i])
+		}
+	}
+}
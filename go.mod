@@ -10,18 +10,19 @@ require (
 	github.com/aletheia7/sd/v6 v6.10.0
 	github.com/florianl/go-nfqueue v1.3.0
 	github.com/google/gopacket v1.1.19
+	github.com/google/nftables v0.0.0-20220808154552-2eca00135732
+	github.com/k-sone/critbitgo v1.4.0
 	github.com/magefile/mage v1.13.0
 	github.com/mattn/go-sqlite3 v1.14.12
+	github.com/mdlayher/netlink v1.6.0
+	golang.org/x/sys v0.0.0-20220319134239-a9b59b0215f8
 )
 
 require (
 	github.com/google/go-cmp v0.5.7 // indirect
 	github.com/josharian/native v1.0.0 // indirect
-	github.com/k-sone/critbitgo v1.4.0 // indirect
-	github.com/mdlayher/netlink v1.6.0 // indirect
 	github.com/mdlayher/socket v0.2.3 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	golang.org/x/net v0.0.0-20220225172249-27dd8689420f // indirect
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c // indirect
-	golang.org/x/sys v0.0.0-20220319134239-a9b59b0215f8 // indirect
 )
@@ -3,8 +3,12 @@ package list
 import (
 	"fmt"
 	"net"
+	"sort"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/k-sone/critbitgo"
 )
 
 type WB struct {
@@ -15,18 +19,20 @@ type WB struct {
 func New() *WB {
 	return &WB{
 		W: &W{
-			net: map[*net.IPNet]bool{},
+			net: critbitgo.NewNet(),
 			ip:  map[string]bool{},
 		},
 		B: &B{
-			ip: map[string]*time.Time{},
+			ip:  map[string]*Entry{},
+			net: critbitgo.NewNet(),
 		},
 	}
 }
 
 type W struct {
-	mu  sync.RWMutex
-	net map[*net.IPNet]bool
+	mu sync.RWMutex
+	// Prefix trie keyed by network value, longest prefix match
+	net *critbitgo.Net
 	ip  map[string]bool
 }
 
@@ -36,11 +42,7 @@ func (o *W) Lookup(ip net.IP) (found bool) {
 	if found = o.ip[ip2bin(ip)]; found {
 		return
 	}
-	for ipnet := range o.net {
-		if found = ipnet.Contains(ip); found {
-			return
-		}
-	}
+	found, _ = o.net.ContainedIP(ip)
 	return
 }
 
@@ -56,22 +58,29 @@ func (o *W) Add(ip string) error {
 	case *net.IP:
 		o.ip[ip2bin(*t)] = true
 	case *net.IPNet:
-		o.net[t] = true
+		return o.net.Add(t, true)
 	}
 	return nil
 }
 
 // Returns *net.IP | *net.IPNet, error
+// IPv4-mapped IPv6 addresses and networks are returned in their IPv4 form.
+// Host prefixes (/32, /128) are returned as *net.IP.
 func Valid_ip_cidr(ip string) (interface{}, error) {
 	v := net.ParseIP(ip)
 	if v == nil {
 		_, ipnet, err := net.ParseCIDR(ip)
 		if err == nil {
+			ipnet = norm_net(ipnet)
+			if ones, bits := ipnet.Mask.Size(); ones == bits {
+				return &ipnet.IP, nil
+			}
 			return ipnet, nil
 		} else {
 			return ``, err
 		}
 	} else {
+		v = norm_ip(v)
 		return &v, nil
 	}
 }
@@ -80,89 +89,349 @@ func Valid_ip_cidr(ip string) (interface{}, error) {
 func (o *W) Remove(ip string) {
 	o.mu.Lock()
 	defer o.mu.Unlock()
-	if v := net.ParseIP(ip); v == nil {
-		if _, ipnet, err := net.ParseCIDR(ip); err == nil {
-			delete(o.net, ipnet)
-		}
-	} else {
-		delete(o.ip, ip2bin(v))
+	v, err := Valid_ip_cidr(ip)
+	if err != nil {
+		return
+	}
+	switch t := v.(type) {
+	case *net.IP:
+		delete(o.ip, ip2bin(*t))
+	case *net.IPNet:
+		o.net.Delete(t)
 	}
 }
 
 func (o *W) Len() int {
 	o.mu.RLock()
 	defer o.mu.RUnlock()
-	return len(o.net) + len(o.ip)
+	return o.net.Size() + len(o.ip)
 }
 
+// IPs and networks in CIDR notation
+func (o *W) All() (a []string) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	a = make([]string, 0, o.net.Size()+len(o.ip))
+	for ip := range o.ip {
+		a = append(a, net.IP(ip).String())
+	}
+	o.net.Walk(nil, func(ipnet *net.IPNet, _ interface{}) bool {
+		a = append(a, ipnet.String())
+		return true
+	})
+	return
+}
+
+// B holds single IPs and networks. A Lookup of any address inside a
+// blacklisted network is a hit.
 type B struct {
-	mu sync.RWMutex
-	ip map[string]*time.Time
+	mu  sync.RWMutex
+	ip  map[string]*Entry
+	net *critbitgo.Net
+}
+
+type Entry struct {
+	// Ban time, updated when a banned IP is seen again
+	Ts time.Time
+	// Number of times banned
+	Ct int
+	// Expiry, zero: permanent
+	Exp time.Time
 }
 
+func (o *Entry) Expired(now time.Time) bool {
+	return !o.Exp.IsZero() && o.Exp.Before(now)
+}
+
+// Lookup is true when ip is blacklisted. Expired entries are absent: the
+// firewall dropped them, Expire removes them later.
 func (o *B) Lookup(ip net.IP) (found bool) {
 	o.mu.RLock()
 	defer o.mu.RUnlock()
-	_, found = o.ip[ip2bin(ip)]
+	_, e := o.match(ip, time.Now())
+	return e != nil
+}
+
+func (o *B) Lookup_all(ip net.IP) (e Entry, found bool) {
+	_, e, found = o.Match(ip)
 	return
 }
 
-func (o *B) Lookup_all(ip net.IP) (ts *time.Time, found bool) {
+// Match returns the blacklist entry containing ip. entry is the IP or the
+// longest matching network in CIDR notation. Expired entries are absent.
+func (o *B) Match(ip net.IP) (entry string, e Entry, found bool) {
 	o.mu.RLock()
 	defer o.mu.RUnlock()
-	ts, found = o.ip[ip2bin(ip)]
+	if entry, v := o.match(ip, time.Now()); v != nil {
+		return entry, *v, true
+	}
+	return
+}
+
+// Lookup_net returns true when ipnet is equal to or inside a blacklisted
+// network. Expired entries are absent.
+func (o *B) Lookup_net(ipnet *net.IPNet) (found bool) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	route, _ := o.match_net(norm_net(ipnet), time.Now())
+	return route != nil
+}
+
+// Inside returns the IPs and networks inside ipnet, expired too. ipnet itself
+// is not returned.
+func (o *B) Inside(ipnet *net.IPNet) (a []string) {
+	ipnet = norm_net(ipnet)
+	ones, bits := ipnet.Mask.Size()
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	for ip := range o.ip {
+		if v := net.IP(ip); len(v)*8 == bits && ipnet.Contains(v) {
+			a = append(a, v.String())
+		}
+	}
+	o.net.Walk(nil, func(n *net.IPNet, _ interface{}) bool {
+		if n_ones, n_bits := n.Mask.Size(); n_bits == bits && ones < n_ones && ipnet.Contains(n.IP) {
+			a = append(a, n.String())
+		}
+		return true
+	})
+	sort.Strings(a)
 	return
 }
 
-func (o *B) Add(ip string, ts *time.Time) error {
+// Covered is true when ip, an IP or network, is inside another unexpired
+// network
+func (o *B) Covered(ip string) bool {
+	v, err := Valid_ip_cidr(ip)
+	if err != nil {
+		return false
+	}
+	var ipnet *net.IPNet
+	switch t := v.(type) {
+	case *net.IP:
+		host := norm_ip(*t)
+		ipnet = &net.IPNet{IP: host, Mask: net.CIDRMask(8*len(host), 8*len(host))}
+	case *net.IPNet:
+		ones, bits := t.Mask.Size()
+		if ones == 0 {
+			return false
+		}
+		mask := net.CIDRMask(ones-1, bits)
+		ipnet = &net.IPNet{IP: t.IP.Mask(mask), Mask: mask}
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	route, _ := o.match_net(ipnet, time.Now())
+	return route != nil
+}
+
+// match returns the unexpired IP or longest network entry containing ip. The
+// caller holds mu.
+func (o *B) match(ip net.IP, now time.Time) (string, *Entry) {
+	ip = norm_ip(ip)
+	if ip == nil {
+		return ``, nil
+	}
+	if v, ok := o.ip[string(ip)]; ok && !v.Expired(now) {
+		return ip.String(), v
+	}
+	bits := 8 * len(ip)
+	route, v := o.match_net(&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, now)
+	if route == nil {
+		return ``, nil
+	}
+	return route.String(), v
+}
+
+// match_net returns the longest unexpired network containing ipnet. An
+// expired network is skipped for a shorter one. The caller holds mu.
+func (o *B) match_net(ipnet *net.IPNet, now time.Time) (*net.IPNet, *Entry) {
+	for {
+		route, v, err := o.net.Match(ipnet)
+		if err != nil || route == nil {
+			return nil, nil
+		}
+		if e := v.(*Entry); !e.Expired(now) {
+			return route, e
+		}
+		ones, bits := route.Mask.Size()
+		if ones == 0 {
+			return nil, nil
+		}
+		mask := net.CIDRMask(ones-1, bits)
+		ipnet = &net.IPNet{IP: route.IP.Mask(mask), Mask: mask}
+	}
+}
+
+// ip: net.IP or net.IPNet
+func (o *B) Add(ip string, e Entry) error {
 	o.mu.Lock()
 	defer o.mu.Unlock()
-	v := net.ParseIP(ip)
-	if v == nil {
+	v, err := Valid_ip_cidr(ip)
+	if err != nil {
 		return fmt.Errorf("invalid IP %v", ip)
 	}
-	o.ip[ip2bin(v)] = ts
+	switch t := v.(type) {
+	case *net.IP:
+		o.ip[ip2bin(*t)] = &e
+	case *net.IPNet:
+		return o.net.Add(t, &e)
+	}
 	return nil
 }
 
+// ip: net.IP or net.IPNet
 func (o *B) Remove(ip string) {
 	o.mu.Lock()
 	defer o.mu.Unlock()
-	if v := net.ParseIP(ip); v == nil {
+	v, err := Valid_ip_cidr(ip)
+	if err != nil {
 		return
-	} else {
-		delete(o.ip, ip2bin(net.ParseIP(ip)))
+	}
+	switch t := v.(type) {
+	case *net.IP:
+		delete(o.ip, ip2bin(*t))
+	case *net.IPNet:
+		o.net.Delete(t)
 	}
 }
 
-func (o *B) Expire(dur time.Duration) int {
+// Expire removes expired entries and returns them
+func (o *B) Expire() (expired []string) {
 	o.mu.Lock()
 	defer o.mu.Unlock()
 	now := time.Now()
-	for ip, ts := range o.ip {
-		if ts.Add(dur).Before(now) {
+	expired = []string{}
+	for ip, e := range o.ip {
+		if e.Expired(now) {
 			delete(o.ip, ip)
+			expired = append(expired, net.IP(ip).String())
 		}
 	}
-	return o.Len()
+	expired_net := []*net.IPNet{}
+	o.net.Walk(nil, func(ipnet *net.IPNet, v interface{}) bool {
+		if v.(*Entry).Expired(now) {
+			expired_net = append(expired_net, ipnet)
+		}
+		return true
+	})
+	for _, ipnet := range expired_net {
+		o.net.Delete(ipnet)
+		expired = append(expired, ipnet.String())
+	}
+	return
 }
 
+// IPs and networks in CIDR notation
 func (o *B) All() (a []string) {
 	o.mu.RLock()
 	defer o.mu.RUnlock()
-	a = make([]string, 0, len(o.ip))
+	a = make([]string, 0, o.len())
 	for ip := range o.ip {
-		a = append(a, ip)
+		a = append(a, net.IP(ip).String())
 	}
+	o.net.Walk(nil, func(ipnet *net.IPNet, _ interface{}) bool {
+		a = append(a, ipnet.String())
+		return true
+	})
 	return
 }
 
+// Entries returns a copy of all entries keyed by IP or network in CIDR notation
+func (o *B) Entries() map[string]Entry {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	m := make(map[string]Entry, o.len())
+	for ip, e := range o.ip {
+		m[net.IP(ip).String()] = *e
+	}
+	o.net.Walk(nil, func(ipnet *net.IPNet, v interface{}) bool {
+		m[ipnet.String()] = *v.(*Entry)
+		return true
+	})
+	return m
+}
+
 func (o *B) Len() int {
 	o.mu.RLock()
 	defer o.mu.RUnlock()
-	return len(o.ip)
+	return o.len()
+}
+
+func (o *B) len() int {
+	return len(o.ip) + o.net.Size()
+}
+
+// Steps are escalating ban durations indexed by ban count. The last step
+// repeats. A 0 step is permanent.
+type Steps []time.Duration
+
+// s: comma separated durations. Example: 1h,24h,168h,0
+func Parse_steps(s string) (Steps, error) {
+	a := strings.Split(s, `,`)
+	o := make(Steps, 0, len(a))
+	for _, v := range a {
+		d, err := time.ParseDuration(strings.TrimSpace(v))
+		if err != nil {
+			return nil, err
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("negative ban duration: %v", v)
+		}
+		o = append(o, d)
+	}
+	return o, nil
+}
+
+// Dur returns the ban duration for ban count ct
+func (o Steps) Dur(ct int) time.Duration {
+	switch {
+	case len(o) == 0:
+		return 0
+	case ct < 1:
+		ct = 1
+	case len(o) < ct:
+		ct = len(o)
+	}
+	return o[ct-1]
+}
+
+// Scale returns the ban duration for ban count ct when a source has its own
+// base duration. base is escalated by the same factor as the steps: with
+// steps 1h,24h,0 and base 10m, ct 2 is 4h. base 0 is Dur(ct).
+func (o Steps) Scale(ct int, base time.Duration) time.Duration {
+	d := o.Dur(ct)
+	if base == 0 || d == 0 || o[0] == 0 {
+		return d
+	}
+	return time.Duration(float64(base) * (float64(d) / float64(o[0])))
+}
+
+// Exp returns the expiry of a ban at ts, zero: permanent
+func (o Steps) Exp(ts time.Time, ct int, base time.Duration) time.Time {
+	if d := o.Scale(ct, base); d != 0 {
+		return ts.Add(d)
+	}
+	return time.Time{}
 }
 
+// 4 byte string key for IPv4 and IPv4-mapped IPv6, 16 byte string key for IPv6
 func ip2bin(ip net.IP) string {
-	return string(ip.To4())
+	return string(norm_ip(ip))
+}
+
+func norm_ip(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip.To16()
+}
+
+// ::ffff:192.0.2.0/120 becomes 192.0.2.0/24
+func norm_net(ipnet *net.IPNet) *net.IPNet {
+	ones, bits := ipnet.Mask.Size()
+	if v4 := ipnet.IP.To4(); v4 != nil && bits == 8*net.IPv6len && 96 <= ones {
+		return &net.IPNet{IP: v4, Mask: net.CIDRMask(ones-96, 8*net.IPv4len)}
+	}
+	return ipnet
 }
@@ -0,0 +1,320 @@
+package list
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_ipv6(t *testing.T) {
+	wb := New()
+	now := time.Now()
+	for _, s := range []string{`2001:db8::1`, `192.0.2.1`} {
+		if err := wb.B.Add(s, Entry{Ts: now, Ct: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		ip    string
+		found bool
+	}{
+		{`2001:db8::1`, true},
+		{`2001:db8:0:0::1`, true},
+		{`2001:db8::2`, false},
+		{`2001:db9::1`, false},
+		{`192.0.2.1`, true},
+		{`::ffff:192.0.2.1`, true},
+		{`192.0.2.2`, false},
+	} {
+		if found := wb.B.Lookup(net.ParseIP(tc.ip)); found != tc.found {
+			t.Errorf("B.Lookup(%v): %v, expected: %v", tc.ip, found, tc.found)
+		}
+	}
+	if wb.B.Len() != 2 {
+		t.Fatalf("B.Len: %v, expected: 2", wb.B.Len())
+	}
+	wb.B.Remove(`::ffff:192.0.2.1`)
+	if wb.B.Lookup(net.ParseIP(`192.0.2.1`)) {
+		t.Fatal("IPv4-mapped remove failed")
+	}
+	if a := wb.B.All(); len(a) != 1 || a[0] != `2001:db8::1` {
+		t.Fatalf("B.All: %v", a)
+	}
+	for _, s := range []string{`2001:db8:1::/48`, `::ffff:198.51.100.0/120`} {
+		if err := wb.W.Add(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		ip    string
+		found bool
+	}{
+		{`2001:db8:1:ffff::1`, true},
+		{`2001:db8:2::1`, false},
+		{`198.51.100.7`, true},
+		{`198.51.101.7`, false},
+	} {
+		if found := wb.W.Lookup(net.ParseIP(tc.ip)); found != tc.found {
+			t.Errorf("W.Lookup(%v): %v, expected: %v", tc.ip, found, tc.found)
+		}
+	}
+}
+
+func Test_valid_ip_cidr(t *testing.T) {
+	for _, tc := range []struct {
+		in, expect string
+	}{
+		{`192.0.2.1`, `192.0.2.1`},
+		{`::ffff:192.0.2.1`, `192.0.2.1`},
+		{`2001:DB8:0::1`, `2001:db8::1`},
+		{`192.0.2.0/24`, `192.0.2.0/24`},
+		{`::ffff:192.0.2.0/120`, `192.0.2.0/24`},
+		{`2001:db8::/32`, `2001:db8::/32`},
+	} {
+		v, err := Valid_ip_cidr(tc.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var s string
+		switch x := v.(type) {
+		case *net.IP:
+			s = x.String()
+		case *net.IPNet:
+			s = x.String()
+		}
+		if s != tc.expect {
+			t.Errorf("Valid_ip_cidr(%v): %v, expected: %v", tc.in, s, tc.expect)
+		}
+	}
+	if _, err := Valid_ip_cidr(`2001:db8::zz`); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func Test_w_net(t *testing.T) {
+	w := New().W
+	for _, s := range []string{`10.0.0.0/8`, `10.1.0.0/16`, `2001:db8::/32`, `192.0.2.1`} {
+		if err := w.Add(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if w.Len() != 4 {
+		t.Fatalf("W.Len: %v, expected: 4", w.Len())
+	}
+	// Remove by value: a freshly parsed network must match the stored network
+	w.Remove(`10.0.0.0/8`)
+	for _, tc := range []struct {
+		ip    string
+		found bool
+	}{
+		{`10.1.2.3`, true},
+		{`10.2.2.3`, false},
+		{`2001:db8::77`, true},
+		{`192.0.2.1`, true},
+	} {
+		if found := w.Lookup(net.ParseIP(tc.ip)); found != tc.found {
+			t.Errorf("W.Lookup(%v): %v, expected: %v", tc.ip, found, tc.found)
+		}
+	}
+	w.Remove(`10.1.0.0/16`)
+	w.Remove(`2001:db8::/32`)
+	w.Remove(`192.0.2.1`)
+	if w.Len() != 0 {
+		t.Fatalf("W.Len: %v, expected: 0", w.Len())
+	}
+	if w.Lookup(net.ParseIP(`10.1.2.3`)) {
+		t.Fatal("found after remove")
+	}
+}
+
+func Test_b_net(t *testing.T) {
+	b := New().B
+	old := time.Now().Add(-time.Hour * 2)
+	now := time.Now()
+	steps := Steps{time.Hour}
+	for _, tc := range []struct {
+		ip string
+		ts time.Time
+	}{
+		{`203.0.113.0/24`, now},
+		{`198.51.100.0/24`, old},
+		{`2001:db8:bad::/48`, now},
+		{`192.0.2.9/32`, now},
+	} {
+		if err := b.Add(tc.ip, Entry{Ts: tc.ts, Ct: 1, Exp: steps.Exp(tc.ts, 1, 0)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		ip, entry string
+	}{
+		{`203.0.113.77`, `203.0.113.0/24`},
+		{`::ffff:203.0.113.77`, `203.0.113.0/24`},
+		{`2001:db8:bad:1::1`, `2001:db8:bad::/48`},
+		{`192.0.2.9`, `192.0.2.9`},
+		{`203.0.114.1`, ``},
+	} {
+		entry, _, found := b.Match(net.ParseIP(tc.ip))
+		if entry != tc.entry || found != (0 < len(tc.entry)) {
+			t.Errorf("B.Match(%v): %v %v, expected: %v", tc.ip, entry, found, tc.entry)
+		}
+		if b.Lookup(net.ParseIP(tc.ip)) != found {
+			t.Errorf("B.Lookup(%v) != B.Match", tc.ip)
+		}
+	}
+	_, ipnet, _ := net.ParseCIDR(`203.0.113.128/25`)
+	if !b.Lookup_net(ipnet) {
+		t.Error("B.Lookup_net /25 inside /24")
+	}
+	if a := b.Expire(); len(a) != 1 || a[0] != `198.51.100.0/24` {
+		t.Fatalf("B.Expire: %v, expected: 198.51.100.0/24", a)
+	}
+	if n := b.Len(); n != 3 {
+		t.Fatalf("B.Len: %v, expected: 3", n)
+	}
+	if m := b.Entries(); len(m) != 3 || m[`2001:db8:bad::/48`].Ct != 1 {
+		t.Fatalf("B.Entries: %v", m)
+	}
+	if b.Lookup(net.ParseIP(`198.51.100.1`)) {
+		t.Fatal("expired network found")
+	}
+	b.Remove(`203.0.113.0/24`)
+	if b.Lookup(net.ParseIP(`203.0.113.77`)) {
+		t.Fatal("removed network found")
+	}
+	if a := b.All(); len(a) != 2 {
+		t.Fatalf("B.All: %v", a)
+	}
+}
+
+func Test_b_expired(t *testing.T) {
+	b := New().B
+	now := time.Now()
+	for s, exp := range map[string]time.Time{
+		`192.0.2.1`:       now.Add(-time.Second),
+		`192.0.2.2`:       now.Add(time.Hour),
+		`198.51.100.0/24`: {},
+		`198.51.100.0/28`: now.Add(-time.Second),
+		`203.0.113.0/24`:  now.Add(-time.Second),
+	} {
+		if err := b.Add(s, Entry{Ts: now, Ct: 1, Exp: exp}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for ip, expect := range map[string]string{
+		`192.0.2.1`:    ``,
+		`192.0.2.2`:    `192.0.2.2`,
+		`198.51.100.1`: `198.51.100.0/24`,
+		`203.0.113.1`:  ``,
+	} {
+		entry, _, found := b.Match(net.ParseIP(ip))
+		if entry != expect || found != (0 < len(expect)) || b.Lookup(net.ParseIP(ip)) != found {
+			t.Errorf("%v: %q %v, expected: %q", ip, entry, found, expect)
+		}
+	}
+	_, ipnet, _ := net.ParseCIDR(`203.0.113.0/25`)
+	if b.Lookup_net(ipnet) {
+		t.Error("Lookup_net: expired network")
+	}
+	if a := b.Expire(); len(a) != 3 {
+		t.Error("Expire:", a)
+	}
+}
+
+func Test_b_inside(t *testing.T) {
+	b := New().B
+	now := time.Now()
+	for s, exp := range map[string]time.Time{
+		`192.0.2.1`:       {},
+		`192.0.2.200`:     now.Add(-time.Second),
+		`192.0.2.64/26`:   {},
+		`192.0.2.0/24`:    {},
+		`192.0.3.1`:       {},
+		`2001:db8::1`:     {},
+		`198.51.100.0/24`: now.Add(-time.Second),
+		`198.51.100.7`:    {},
+	} {
+		if err := b.Add(s, Entry{Ts: now, Ct: 1, Exp: exp}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, ipnet, _ := net.ParseCIDR(`192.0.2.0/24`)
+	if a := b.Inside(ipnet); strings.Join(a, ` `) != `192.0.2.1 192.0.2.200 192.0.2.64/26` {
+		t.Error("Inside:", a)
+	}
+	for ip, expect := range map[string]bool{
+		`192.0.2.1`:     true,
+		`192.0.2.64/26`: true,
+		`192.0.2.0/24`:  false,
+		`192.0.3.1`:     false,
+		`2001:db8::1`:   false,
+		`198.51.100.7`:  false,
+	} {
+		if b.Covered(ip) != expect {
+			t.Errorf("Covered: %v, expected: %v", ip, expect)
+		}
+	}
+}
+
+func Test_steps(t *testing.T) {
+	steps, err := Parse_steps(`1h, 24h,168h,0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		ct  int
+		dur time.Duration
+	}{
+		{0, time.Hour},
+		{1, time.Hour},
+		{2, time.Hour * 24},
+		{3, time.Hour * 168},
+		{4, 0},
+		{99, 0},
+	} {
+		if d := steps.Dur(tc.ct); d != tc.dur {
+			t.Errorf("Dur(%v): %v, expected: %v", tc.ct, d, tc.dur)
+		}
+	}
+	for _, tc := range []struct {
+		ct        int
+		base, dur time.Duration
+	}{
+		{1, time.Minute * 10, time.Minute * 10},
+		{2, time.Minute * 10, time.Hour * 4},
+		{4, time.Minute * 10, 0},
+		{2, 0, time.Hour * 24},
+	} {
+		if d := steps.Scale(tc.ct, tc.base); d != tc.dur {
+			t.Errorf("Scale(%v, %v): %v, expected: %v", tc.ct, tc.base, d, tc.dur)
+		}
+	}
+	now := time.Now()
+	b := New().B
+	for _, tc := range []struct {
+		ip string
+		ts time.Time
+		ct int
+	}{
+		{`192.0.2.1`, now.Add(-time.Hour * 2), 1},
+		{`192.0.2.2`, now.Add(-time.Hour * 2), 2},
+		{`192.0.2.3`, now.Add(-time.Hour * 24 * 365), 4},
+	} {
+		b.Add(tc.ip, Entry{Ts: tc.ts, Ct: tc.ct, Exp: steps.Exp(tc.ts, tc.ct, 0)})
+	}
+	if a := b.Expire(); len(a) != 1 {
+		t.Fatalf("B.Expire: %v, expected: 192.0.2.1", a)
+	}
+	if b.Lookup(net.ParseIP(`192.0.2.1`)) {
+		t.Fatal("1h ban not expired")
+	}
+	if e, found := b.Lookup_all(net.ParseIP(`192.0.2.3`)); !found || e.Ct != 4 {
+		t.Fatal("permanent ban expired")
+	}
+	for _, s := range []string{``, `1h,x`, `-1h`} {
+		if _, err := Parse_steps(s); err == nil {
+			t.Errorf("Parse_steps(%q): expected error", s)
+		}
+	}
+}
@@ -1,96 +1,470 @@
 // Copyright 2018 aletheia7. All rights reserved. Use of this source code is
 // governed by a BSD-2-Clause license that can be found in the LICENSE file.
 
+// Package nft maintains a banip owned nftables table over netlink. The table
+// holds an input chain and IPv4/IPv6 interval sets with per element timeouts.
+// Packets with a source address in a set are dropped. Changes are sent as
+// atomic batches.
 package nft
 
 import (
+	"bytes"
 	"fmt"
-	"os/exec"
-	"regexp"
-	"strings"
+	"math/big"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/aletheia7/banip/fw"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
 )
 
-const Rule_marker = " ☢ ban ☢ "
+// Chain is the name of the input chain in the banip table
+const Chain = `input`
 
-type Err struct {
-	Err    error
-	Args   []string
-	Output []byte
-}
+// Element is a set element
+type Element = fw.Element
+
+var _ fw.Driver = &Table{}
+var _ fw.Refresher = &Table{}
+var _ fw.Replacer = &Table{}
 
 type Table struct {
 	Family string
 	Table  string
-	Set    string
-}
-
-func New_table(family, table, set, device string) (*Table, *Err) {
-	o := &Table{Family: family, Table: table, Set: set}
-	o.remove_previous()
-	re := `(?m)\s+ct state invalid drop # handle (\d+)$`
-	add_handle := o.get_insertion_handle(re)
-	if len(add_handle) == 0 {
-		return nil, &Err{Err: fmt.Errorf("cannot find handle for re: %v", re), Args: []string{}, Output: []byte{}}
-	}
-	for _, cmd := range []*exec.Cmd{
-		// exec.Command("nft", "add", "table", o.Family, o.Table),
-		exec.Command("nft", "add", "set", o.Family, o.Table, o.Set, `{ type ipv4_addr; }`),
-		// exec.Command("nft", "add", "chain", o.Family, o.Table, `input`, `{ type filter hook ingress device `+device+` priority 0; policy accept; }`),
-		exec.Command("nft", "add", "rule", o.Family, o.Table, `input`, `handle`, add_handle, `ip saddr @`+set+` drop comment "`+Rule_marker+`"`),
+	// Set holds IPv4 addresses, Set6 holds IPv6 addresses. Set6 is empty
+	// for family ip, Set is empty for family ip6.
+	Set      string
+	Set6     string
+	Priority int
+	mu       sync.Mutex
+	conn     *nftables.Conn
+	conn_opt []nftables.ConnOption
+	t        *nftables.Table
+	set      *nftables.Set
+	set6     *nftables.Set
+}
+
+type option func(*Table)
+
+// Chain hook priority. Default -10, before the filter priority 0.
+// Example: nft.Priority(-150)
+func Priority(p int) option {
+	return func(o *Table) {
+		o.Priority = p
+	}
+}
+
+// Conn_options are passed to nftables.New, i.e. nftables.WithNetNSFd
+func Conn_options(opt ...nftables.ConnOption) option {
+	return func(o *Table) {
+		o.conn_opt = append(o.conn_opt, opt...)
+	}
+}
+
+// family: ip, ip6 or inet. inet uses both sets. The IPv6 set is named set + "6".
+// A previous table with the same name is replaced, sets start empty.
+func New_table(family, table, set string, opt ...option) (*Table, error) {
+	o, err := new_table(family, table, set, opt...)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.Reset(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// Reset replaces the table, i.e. after a ruleset flush. Sets start empty.
+func (o *Table) Reset() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	policy := nftables.ChainPolicyAccept
+	// Create, delete, create: the table is replaced whether it exists or not
+	o.conn.AddTable(o.t)
+	o.conn.DelTable(o.t)
+	o.conn.AddTable(o.t)
+	ch := o.conn.AddChain(&nftables.Chain{
+		Name:     Chain,
+		Table:    o.t,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookInput,
+		Priority: nftables.ChainPriority(o.Priority),
+		Policy:   &policy,
+	})
+	for _, s := range []struct {
+		name   string
+		set    **nftables.Set
+		key    nftables.SetDatatype
+		proto  byte
+		offset uint32
+	}{
+		{o.Set, &o.set, nftables.TypeIPAddr, unix.NFPROTO_IPV4, 12},
+		{o.Set6, &o.set6, nftables.TypeIP6Addr, unix.NFPROTO_IPV6, 8},
 	} {
-		if b, err := cmd.CombinedOutput(); err != nil {
-			return nil, &Err{Err: err, Args: cmd.Args, Output: b}
+		if len(s.name) == 0 {
+			continue
+		}
+		*s.set = &nftables.Set{
+			Table:      o.t,
+			Name:       s.name,
+			KeyType:    s.key,
+			Interval:   true,
+			HasTimeout: true,
+		}
+		if err := o.conn.AddSet(*s.set, nil); err != nil {
+			return err
+		}
+		exprs := []expr.Any{}
+		if o.t.Family == nftables.TableFamilyINet {
+			exprs = append(exprs,
+				&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{s.proto}},
+			)
+		}
+		exprs = append(exprs,
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: s.offset, Len: s.key.Bytes},
+			&expr.Lookup{SourceRegister: 1, SetName: s.name, SetID: (*s.set).ID},
+			&expr.Verdict{Kind: expr.VerdictDrop},
+		)
+		o.conn.AddRule(&nftables.Rule{
+			Table:    o.t,
+			Chain:    ch,
+			Exprs:    exprs,
+			UserData: comment(fw.Rule_marker),
+		})
+	}
+	if err := o.conn.Flush(); err != nil {
+		return fmt.Errorf("nft table %v %v: %w", o.Family, o.Table, err)
+	}
+	return nil
+}
+
+// Open_table uses an existing table made by New_table, i.e. by a running
+// banip. The table is not changed.
+func Open_table(family, table, set string, opt ...option) (*Table, error) {
+	o, err := new_table(family, table, set, opt...)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range []struct {
+		name string
+		set  **nftables.Set
+	}{{o.Set, &o.set}, {o.Set6, &o.set6}} {
+		if len(s.name) == 0 {
+			continue
+		}
+		if *s.set, err = o.conn.GetSetByName(o.t, s.name); err != nil {
+			return nil, fmt.Errorf("nft table %v %v: %w", family, table, err)
 		}
 	}
-	o.Flush_set()
 	return o, nil
 }
 
-func (o *Table) get_insertion_handle(re string) string {
-	if b, err := exec.Command("nft", "-a", "list", "chain", o.Family, o.Table, "input").Output(); err == nil {
-		if m := regexp.MustCompile(re).FindAllSubmatch(b, -1); m != nil {
-			if len(m) == 1 && len(m[0]) == 2 {
-				return string(m[0][1])
-			}
+func new_table(family, table, set string, opt ...option) (*Table, error) {
+	o := &Table{Family: family, Table: table, Priority: -10}
+	for _, op := range opt {
+		op(o)
+	}
+	o.t = &nftables.Table{Name: table}
+	switch family {
+	case `ip`:
+		o.t.Family = nftables.TableFamilyIPv4
+		o.Set = set
+	case `ip6`:
+		o.t.Family = nftables.TableFamilyIPv6
+		o.Set6 = set + `6`
+	case `inet`:
+		o.t.Family = nftables.TableFamilyINet
+		o.Set = set
+		o.Set6 = set + `6`
+	default:
+		return nil, fmt.Errorf("invalid family: %v", family)
+	}
+	var err error
+	if o.conn, err = nftables.New(o.conn_opt...); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// comment returns rule user data as written by nft for: comment "s"
+func comment(s string) []byte {
+	// NFTNL_UDATA_RULE_COMMENT, length, NUL terminated string
+	return append([]byte{0, byte(len(s) + 1)}, append([]byte(s), 0)...)
+}
+
+// Delete removes the table, chain, rules and sets
+func (o *Table) Delete() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.conn.DelTable(o.t)
+	return o.conn.Flush()
+}
+
+func (o *Table) Flush() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, s := range []*nftables.Set{o.set, o.set6} {
+		if s != nil {
+			o.conn.FlushSet(s)
 		}
 	}
-	return ``
+	return o.conn.Flush()
+}
+
+// ip: IPv4 and IPv6 addresses are added to their respective set
+func (o *Table) Add_set(ip ...string) error {
+	e := make([]Element, 0, len(ip))
+	for _, s := range ip {
+		e = append(e, Element{Ip: s})
+	}
+	return o.Add(e...)
+}
+
+// Elements with a Timeout are removed by the kernel. All elements are added
+// in one batch.
+func (o *Table) Add(e ...Element) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.add(e); err != nil {
+		return err
+	}
+	return o.conn.Flush()
+}
+
+// Refresh replaces present elements with e, i.e. a new Timeout. The kernel
+// keeps the timeout of an element added again, the delete and the add are
+// one batch: the IP is dropped throughout.
+func (o *Table) Refresh(e ...Element) error {
+	ip := make([]string, 0, len(e))
+	for _, el := range e {
+		ip = append(ip, el.Ip)
+	}
+	return o.Replace(ip, e...)
 }
 
-func (o *Table) remove_previous() {
-	if b, err := exec.Command("nft", "-a", "list", "chain", o.Family, o.Table, "input").Output(); err == nil {
-		if m := regexp.MustCompile(`"`+Rule_marker+`" # handle (\d+)`).FindAllSubmatch(b, -1); m != nil {
-			for _, line := range m {
-				if 2 <= len(line) {
-					exec.Command("nft", "delete", "rule", o.Family, o.Table, "input", "handle", string(line[1])).Run()
-				}
+// Replace removes rm and adds e in one batch. The interval sets do not merge,
+// a network is added with the IPs and networks inside it removed.
+func (o *Table) Replace(rm []string, e ...Element) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.remove(rm); err != nil {
+		return err
+	}
+	if err := o.add(e); err != nil {
+		return err
+	}
+	return o.conn.Flush()
+}
+
+// add queues the elements. The caller holds mu.
+func (o *Table) add(e []Element) error {
+	v4 := make([]nftables.SetElement, 0, len(e)*2)
+	v6 := make([]nftables.SetElement, 0)
+	for _, el := range e {
+		start, end, err := interval(el.Ip)
+		if err != nil {
+			return err
+		}
+		a := []nftables.SetElement{{Key: start, Timeout: el.Timeout}}
+		if end != nil {
+			// The kernel rejects a timeout on an interval end and removes
+			// the end with an expired start
+			a = append(a, nftables.SetElement{Key: end, IntervalEnd: true})
+		}
+		if len(start) == net.IPv4len {
+			v4 = append(v4, a...)
+		} else {
+			v6 = append(v6, a...)
+		}
+	}
+	return o.set_elements(o.conn.SetAddElements, v4, v6)
+}
+
+// Remove removes IPs or networks. Elements that are not present, for
+// example removed by timeout, are ignored.
+func (o *Table) Remove(ip ...string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.remove(ip); err != nil {
+		return err
+	}
+	return o.conn.Flush()
+}
+
+// remove queues the deletion of the present elements. The caller holds mu.
+func (o *Table) remove(ip []string) error {
+	present := map[*nftables.Set]map[string]bool{}
+	for _, s := range []*nftables.Set{o.set, o.set6} {
+		if s == nil {
+			continue
+		}
+		a, err := o.conn.GetSetElements(s)
+		if err != nil {
+			return fmt.Errorf("nft set %v: %w", s.Name, err)
+		}
+		present[s] = map[string]bool{}
+		for _, el := range a {
+			present[s][key(el)] = true
+		}
+	}
+	v4 := make([]nftables.SetElement, 0, len(ip)*2)
+	v6 := make([]nftables.SetElement, 0)
+	for _, s := range ip {
+		start, end, err := interval(s)
+		if err != nil {
+			return err
+		}
+		set := o.set6
+		if len(start) == net.IPv4len {
+			set = o.set
+		}
+		a := []nftables.SetElement{{Key: start}}
+		if end != nil {
+			a = append(a, nftables.SetElement{Key: end, IntervalEnd: true})
+		}
+		if !present[set][key(a[0])] {
+			continue
+		}
+		if end != nil && !present[set][key(a[1])] {
+			a = a[:1]
+		}
+		if len(start) == net.IPv4len {
+			v4 = append(v4, a...)
+		} else {
+			v6 = append(v6, a...)
+		}
+	}
+	return o.set_elements(o.conn.SetDeleteElements, v4, v6)
+}
+
+// List returns the set contents. Timeout is the timeout the element was
+// added with, not the time remaining.
+func (o *Table) List() ([]Element, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	r := []Element{}
+	for _, s := range []*nftables.Set{o.set, o.set6} {
+		if s == nil {
+			continue
+		}
+		a, err := o.conn.GetSetElements(s)
+		if err != nil {
+			return nil, fmt.Errorf("nft set %v: %w", s.Name, err)
+		}
+		sort.Slice(a, func(i, j int) bool {
+			if c := bytes.Compare(a[i].Key, a[j].Key); c != 0 {
+				return c < 0
+			}
+			// An interval end sorts before a start with the same key
+			return a[i].IntervalEnd && !a[j].IntervalEnd
+		})
+		for i, el := range a {
+			if el.IntervalEnd {
+				continue
+			}
+			var end []byte
+			if i+1 < len(a) && a[i+1].IntervalEnd {
+				end = a[i+1].Key
+			}
+			for _, ip := range cidrs(el.Key, end) {
+				r = append(r, Element{Ip: ip, Timeout: el.Timeout})
 			}
 		}
 	}
+	return r, nil
 }
 
-func (o *Table) Delete() error {
-	cmd := exec.Command("nft", "delete", "table", o.Family, o.Table)
-	if b, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("%v: %v: %s", cmd.Args, err, b)
+// set_elements queues v4 and v6 elements with f
+func (o *Table) set_elements(f func(*nftables.Set, []nftables.SetElement) error, v4, v6 []nftables.SetElement) error {
+	for _, t := range []struct {
+		set *nftables.Set
+		e   []nftables.SetElement
+	}{{o.set, v4}, {o.set6, v6}} {
+		if len(t.e) == 0 {
+			continue
+		}
+		if t.set == nil {
+			return fmt.Errorf("no set for family %v: %v", o.Family, net.IP(t.e[0].Key))
+		}
+		if err := f(t.set, t.e); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func (o *Table) Flush_set() error {
-	cmd := exec.Command("nft", "flush", "set", o.Family, o.Table, o.Set)
-	if b, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("%v: %v: %s", cmd.Args, err, b)
+func key(e nftables.SetElement) string {
+	return fmt.Sprintf("%x %v", e.Key, e.IntervalEnd)
+}
+
+// interval returns the first address and the address after the last address
+// of an IP or network. end is nil when the interval reaches the end of the
+// address space.
+func interval(ip string) (start, end []byte, err error) {
+	var ipnet *net.IPNet
+	if v := net.ParseIP(ip); v != nil {
+		if v4 := v.To4(); v4 != nil {
+			v = v4
+		}
+		ipnet = &net.IPNet{IP: v, Mask: net.CIDRMask(len(v)*8, len(v)*8)}
+	} else if _, ipnet, err = net.ParseCIDR(ip); err != nil {
+		return nil, nil, fmt.Errorf("invalid IP %v", ip)
 	}
-	return nil
+	start = ipnet.IP.To4()
+	if start == nil {
+		start = ipnet.IP.To16()
+	}
+	mask := ipnet.Mask
+	if len(mask) != len(start) {
+		mask = mask[len(mask)-len(start):]
+	}
+	end = make([]byte, len(start))
+	for i := range start {
+		end[i] = start[i] | ^mask[i]
+	}
+	// end + 1
+	for i := len(end) - 1; 0 <= i; i-- {
+		end[i]++
+		if end[i] != 0 {
+			return start, end, nil
+		}
+	}
+	return start, nil, nil
 }
 
-func (o *Table) Add_set(ip ...string) error {
-	if 0 < len(ip) {
-		cmd := exec.Command("nft", "add", "element", o.Family, o.Table, o.Set, `{ `+strings.Join(ip, `,`)+` }`)
-		if b, err := cmd.CombinedOutput(); err != nil {
-			return fmt.Errorf("%v: %v: %s", cmd.Args, err, b)
+// cidrs converts the interval start to end (exclusive, nil: end of the
+// address space) to IPs and networks
+func cidrs(start, end []byte) []string {
+	bits := len(start) * 8
+	s := new(big.Int).SetBytes(start)
+	e := new(big.Int).Lsh(big.NewInt(1), uint(bits))
+	if end != nil {
+		e.SetBytes(end)
+	}
+	r := []string{}
+	one := big.NewInt(1)
+	for s.Cmp(e) < 0 {
+		// Largest block aligned at s that fits before e
+		size := 0
+		for size < bits && s.Bit(size) == 0 {
+			next := new(big.Int).Lsh(one, uint(size+1))
+			if e.Cmp(next.Add(next, s)) < 0 {
+				break
+			}
+			size++
+		}
+		ip := make(net.IP, len(start))
+		s.FillBytes(ip)
+		if size == 0 {
+			r = append(r, ip.String())
+		} else {
+			r = append(r, (&net.IPNet{IP: ip, Mask: net.CIDRMask(bits-size, bits)}).String())
 		}
+		s.Add(s, new(big.Int).Lsh(one, uint(size)))
 	}
-	return nil
+	return r
 }
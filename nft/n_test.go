@@ -0,0 +1,285 @@
+package nft
+
+import (
+	"encoding/binary"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nltest"
+	"golang.org/x/sys/unix"
+)
+
+// kernel is a fake nf_tables netlink peer. It records message types and keeps
+// set elements.
+type kernel struct {
+	msgs []uint16
+	// message types of the last request
+	last []uint16
+	sets map[string]map[string]elem
+}
+
+type elem struct {
+	key     []byte
+	end     bool
+	timeout uint64
+}
+
+func new_kernel() *kernel {
+	return &kernel{sets: map[string]map[string]elem{}}
+}
+
+func (o *kernel) dial(req []netlink.Message) ([]netlink.Message, error) {
+	reply := []netlink.Message{}
+	if 0 < len(req) {
+		o.last = nil
+	}
+	for _, m := range req {
+		t := uint16(m.Header.Type) & 0xff
+		if uint16(m.Header.Type)>>8 != unix.NFNL_SUBSYS_NFTABLES {
+			continue
+		}
+		o.msgs = append(o.msgs, t)
+		o.last = append(o.last, t)
+		switch t {
+		case unix.NFT_MSG_NEWSET:
+			o.sets[string(attr(m.Data[4:], unix.NFTA_SET_NAME))] = map[string]elem{}
+		case unix.NFT_MSG_NEWSETELEM, unix.NFT_MSG_DELSETELEM:
+			set := o.sets[string(attr(m.Data[4:], unix.NFTA_SET_ELEM_LIST_SET))]
+			for _, e := range elems(attr(m.Data[4:], unix.NFTA_SET_ELEM_LIST_ELEMENTS)) {
+				k := string(e.key) + map[bool]string{true: "end"}[e.end]
+				if t == unix.NFT_MSG_DELSETELEM {
+					if _, ok := set[k]; !ok {
+						return nltest.Error(int(unix.ENOENT), req)
+					}
+					delete(set, k)
+				} else {
+					set[k] = e
+				}
+			}
+		case unix.NFT_MSG_GETSETELEM:
+			keys := []string{}
+			set := o.sets[string(attr(m.Data[4:], unix.NFTA_SET_NAME))]
+			for k := range set {
+				keys = append(keys, k)
+			}
+			// The kernel dumps intervals in reverse order
+			sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+			list := []netlink.Attribute{}
+			for _, k := range keys {
+				e := set[k]
+				a := []netlink.Attribute{{
+					Type: unix.NFTA_SET_ELEM_KEY,
+					Data: nltest.MustMarshalAttributes([]netlink.Attribute{{Type: unix.NFTA_DATA_VALUE, Data: e.key}}),
+				}}
+				if e.end {
+					a = append(a, netlink.Attribute{Type: unix.NFTA_SET_ELEM_FLAGS, Data: be32(unix.NFT_SET_ELEM_INTERVAL_END)})
+				}
+				if 0 < e.timeout {
+					b := make([]byte, 8)
+					binary.BigEndian.PutUint64(b, e.timeout)
+					a = append(a, netlink.Attribute{Type: unix.NFTA_SET_ELEM_TIMEOUT, Data: b})
+				}
+				list = append(list, netlink.Attribute{Type: unix.NFTA_LIST_ELEM, Data: nltest.MustMarshalAttributes(a)})
+			}
+			reply = append(reply, netlink.Message{
+				Header: netlink.Header{Type: netlink.HeaderType(unix.NFNL_SUBSYS_NFTABLES<<8 | unix.NFT_MSG_NEWSETELEM)},
+				Data: append([]byte{unix.NFPROTO_INET, 0, 0, 0}, nltest.MustMarshalAttributes([]netlink.Attribute{
+					{Type: unix.NFTA_SET_ELEM_LIST_ELEMENTS, Data: nltest.MustMarshalAttributes(list)},
+				})...),
+			})
+		}
+	}
+	return reply, nil
+}
+
+func attr(b []byte, t uint16) []byte {
+	a, err := netlink.UnmarshalAttributes(b)
+	if err != nil {
+		panic(err)
+	}
+	for _, v := range a {
+		if v.Type&^unix.NLA_F_NESTED == t {
+			if 0 < len(v.Data) && v.Data[len(v.Data)-1] == 0 && t != unix.NFTA_SET_ELEM_LIST_ELEMENTS {
+				return v.Data[:len(v.Data)-1]
+			}
+			return v.Data
+		}
+	}
+	return nil
+}
+
+func elems(b []byte) []elem {
+	a, err := netlink.UnmarshalAttributes(b)
+	if err != nil {
+		panic(err)
+	}
+	r := []elem{}
+	for _, v := range a {
+		ea, err := netlink.UnmarshalAttributes(v.Data)
+		if err != nil {
+			panic(err)
+		}
+		var e elem
+		for _, x := range ea {
+			switch x.Type &^ unix.NLA_F_NESTED {
+			case unix.NFTA_SET_ELEM_KEY:
+				k, _ := netlink.UnmarshalAttributes(x.Data)
+				e.key = k[0].Data
+			case unix.NFTA_SET_ELEM_FLAGS:
+				e.end = binary.BigEndian.Uint32(x.Data)&unix.NFT_SET_ELEM_INTERVAL_END != 0
+			case unix.NFTA_SET_ELEM_TIMEOUT:
+				e.timeout = binary.BigEndian.Uint64(x.Data)
+			}
+		}
+		r = append(r, e)
+	}
+	return r
+}
+
+func be32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func Test_table(t *testing.T) {
+	k := new_kernel()
+	tb, err := New_table(`inet`, `banip`, `banip`, Priority(-150), Conn_options(nftables.WithTestDial(k.dial)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		t  uint16
+		ct int
+	}{
+		{unix.NFT_MSG_NEWTABLE, 2},
+		{unix.NFT_MSG_DELTABLE, 1},
+		{unix.NFT_MSG_NEWCHAIN, 1},
+		{unix.NFT_MSG_NEWSET, 2},
+		{unix.NFT_MSG_NEWRULE, 2},
+	} {
+		ct := 0
+		for _, m := range k.msgs {
+			if m == tc.t {
+				ct++
+			}
+		}
+		if ct != tc.ct {
+			t.Errorf("message %v: %v, expected: %v", tc.t, ct, tc.ct)
+		}
+	}
+	if len(k.sets) != 2 || k.sets[`banip`] == nil || k.sets[`banip6`] == nil {
+		t.Fatalf("sets: %v", k.sets)
+	}
+	if err := tb.Add(
+		Element{Ip: `192.0.2.1`, Timeout: time.Hour},
+		Element{Ip: `198.51.100.0/24`},
+		Element{Ip: `::ffff:203.0.113.9`},
+		Element{Ip: `2001:db8::/32`, Timeout: time.Minute},
+		Element{Ip: `255.255.255.255`},
+	); err != nil {
+		t.Fatal(err)
+	}
+	// 5 starts, 4 ends: 255.255.255.255 has no end
+	if n := len(k.sets[`banip`]) + len(k.sets[`banip6`]); n != 9 {
+		t.Fatalf("elements: %v, expected: 9", n)
+	}
+	a, err := tb.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]time.Duration{
+		`192.0.2.1`:       time.Hour,
+		`198.51.100.0/24`: 0,
+		`203.0.113.9`:     0,
+		`255.255.255.255`: 0,
+		`2001:db8::/32`:   time.Minute,
+	}
+	if len(a) != len(expect) {
+		t.Fatalf("List: %v", a)
+	}
+	for _, e := range a {
+		if d, ok := expect[e.Ip]; !ok || d != e.Timeout {
+			t.Errorf("List: %v %v", e.Ip, e.Timeout)
+		}
+	}
+	// One batch deletes and adds, 203.0.113.10 is not present
+	if err := tb.Refresh(Element{Ip: `198.51.100.0/24`, Timeout: time.Hour}, Element{Ip: `203.0.113.10`}); err != nil {
+		t.Fatal(err)
+	}
+	batch := map[uint16]int{}
+	for _, m := range k.last {
+		batch[m]++
+	}
+	if batch[unix.NFT_MSG_DELSETELEM] != 1 || batch[unix.NFT_MSG_NEWSETELEM] != 1 {
+		t.Errorf("Refresh batch: %v", k.last)
+	}
+	if a, _ = tb.List(); len(a) != 6 {
+		t.Fatalf("List after Refresh: %v", a)
+	}
+	for _, e := range a {
+		if e.Ip == `198.51.100.0/24` && e.Timeout != time.Hour {
+			t.Errorf("Refresh: %v %v", e.Ip, e.Timeout)
+		}
+	}
+	// A network replaces the IPs inside it in one batch
+	if err := tb.Replace([]string{`203.0.113.9`, `203.0.113.10`}, Element{Ip: `203.0.113.0/24`}); err != nil {
+		t.Fatal(err)
+	}
+	batch = map[uint16]int{}
+	for _, m := range k.last {
+		batch[m]++
+	}
+	if batch[unix.NFT_MSG_DELSETELEM] != 1 || batch[unix.NFT_MSG_NEWSETELEM] != 1 {
+		t.Errorf("Replace batch: %v", k.last)
+	}
+	if a, _ = tb.List(); len(a) != 5 {
+		t.Fatalf("List after Replace: %v", a)
+	}
+	for _, e := range a {
+		if e.Ip == `203.0.113.9` || e.Ip == `203.0.113.10` {
+			t.Errorf("Replace: %v present", e.Ip)
+		}
+	}
+	if err := tb.Remove(`203.0.113.10`); err != nil {
+		t.Fatal(err)
+	}
+	// 192.0.2.2 is not present and must not fail the batch
+	if err := tb.Remove(`192.0.2.1`, `192.0.2.2`, `2001:db8::/32`, `255.255.255.255`); err != nil {
+		t.Fatal(err)
+	}
+	if a, _ = tb.List(); len(a) != 2 {
+		t.Fatalf("List after Remove: %v", a)
+	}
+	if _, err := New_table(`arp`, `banip`, `banip`, Conn_options(nftables.WithTestDial(k.dial))); err == nil {
+		t.Error("expected family error")
+	}
+}
+
+func Test_cidrs(t *testing.T) {
+	for _, tc := range []struct {
+		ip     string
+		expect []string
+	}{
+		{`10.0.0.0/8`, []string{`10.0.0.0/8`}},
+		{`10.0.0.1`, []string{`10.0.0.1`}},
+		{`2001:db8::1`, []string{`2001:db8::1`}},
+		{`0.0.0.0/0`, []string{`0.0.0.0/0`}},
+	} {
+		start, end, err := interval(tc.ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a := cidrs(start, end); len(a) != 1 || a[0] != tc.expect[0] {
+			t.Errorf("cidrs(%v): %v, expected: %v", tc.ip, a, tc.expect)
+		}
+	}
+	// A merged range: 10.0.0.1 - 10.0.0.6
+	a := cidrs([]byte{10, 0, 0, 1}, []byte{10, 0, 0, 7})
+	if len(a) != 4 || a[0] != `10.0.0.1` || a[1] != `10.0.0.2/31` || a[2] != `10.0.0.4/31` || a[3] != `10.0.0.6` {
+		t.Errorf("cidrs: %v", a)
+	}
+}
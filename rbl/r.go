@@ -2,6 +2,7 @@ package rbl
 
 import (
 	"net"
+	"strconv"
 	"strings"
 
 	"github.com/aletheia7/gogroup"
@@ -23,10 +24,9 @@ func New(gg *gogroup.Group, rbls []string) *Search {
 }
 
 func (o *Search) Lookup(ip net.IP, just_first bool) (ret []string) {
-	ip_rev := net.IP(make([]byte, len(ip.To4())))
-	copy(ip_rev, ip.To4())
-	for i, j := 0, len(ip_rev)-1; i < j; i, j = i+1, j-1 {
-		ip_rev[i], ip_rev[j] = ip_rev[j], ip_rev[i]
+	ip_rev := reverse(ip)
+	if len(ip_rev) == 0 {
+		return
 	}
 	if just_first {
 		ret = make([]string, 0, 1)
@@ -40,7 +40,7 @@ func (o *Search) Lookup(ip net.IP, just_first bool) (ret []string) {
 		default:
 		}
 		for try := 2; 0 < try; try-- {
-			a, err := net.LookupHost(ip_rev.String() + "." + h)
+			a, err := net.LookupHost(ip_rev + "." + h)
 			switch {
 			case err == nil:
 				try = 0
@@ -61,3 +61,25 @@ func (o *Search) Lookup(ip net.IP, just_first bool) (ret []string) {
 	}
 	return
 }
+
+// reverse returns the dnsbl query label: 192.0.2.1 -> 1.2.0.192,
+// 2001:db8::1 -> 1.0.0.0 ... 8.b.d.0.1.0.0.2 (nibble format)
+func reverse(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		ip_rev := net.IP(make([]byte, len(v4)))
+		copy(ip_rev, v4)
+		for i, j := 0, len(ip_rev)-1; i < j; i, j = i+1, j-1 {
+			ip_rev[i], ip_rev[j] = ip_rev[j], ip_rev[i]
+		}
+		return ip_rev.String()
+	}
+	v6 := ip.To16()
+	if v6 == nil {
+		return ``
+	}
+	a := make([]string, 0, len(v6)*2)
+	for i := len(v6) - 1; 0 <= i; i-- {
+		a = append(a, strconv.FormatUint(uint64(v6[i]&0xf), 16), strconv.FormatUint(uint64(v6[i]>>4), 16))
+	}
+	return strings.Join(a, `.`)
+}
@@ -121,7 +121,7 @@ func (o *scanner) Split(data []byte, atEOF bool) (advance int, token []byte, err
 	if data[abs_nl_pos] == '\n' {
 		advance = abs_nl_pos
 		token = data[0:0]
-		o.entry[string(data[:rel_equal_nl_pos+1])] = string(data[abs_bin_end_pos:abs_nl_pos])
+		o.entry[string(data[:rel_equal_nl_pos])] = string(data[abs_bin_end_pos:abs_nl_pos])
 		return
 	}
 	// Seek past garbage. Should never get here. Protocol is violated.
@@ -1,11 +1,14 @@
 package rlog
 
 import (
+	"bytes"
+	"encoding/binary"
 	"io/ioutil"
 	"os"
 	"regexp"
 	"testing"
 
+	"github.com/aletheia7/banip/server/rlog/jep"
 	"github.com/aletheia7/gogroup"
 )
 
@@ -47,3 +50,20 @@ func Test_read(t *testing.T) {
 		}
 	}
 }
+
+// A binary field, i.e. a MESSAGE with a newline, is keyed by its name
+func Test_binary_field(t *testing.T) {
+	msg := "proxy; rspamd_task_write_log:\nα"
+	var b bytes.Buffer
+	b.WriteString("__CURSOR=s=1\nMESSAGE\n")
+	binary.Write(&b, binary.LittleEndian, uint64(len(msg)))
+	b.WriteString(msg + "\nSYSLOG_IDENTIFIER=rspamd\n\n")
+	c, _ := jep.New(gg, &b)
+	e, ok := <-c
+	if !ok {
+		t.Fatal("no entry")
+	}
+	if e[`MESSAGE`] != msg || e[`SYSLOG_IDENTIFIER`] != `rspamd` || e[`__CURSOR`] != `s=1` {
+		t.Errorf("entry: %q", e)
+	}
+}
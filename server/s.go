@@ -4,8 +4,9 @@
 package server
 
 import (
-	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/json"
 	"flag"
@@ -15,16 +16,29 @@ import (
 	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/aletheia7/banip/ctl"
 	"github.com/aletheia7/banip/filter"
+	"github.com/aletheia7/banip/fw"
+	"github.com/aletheia7/banip/fw/file"
+	"github.com/aletheia7/banip/fw/ipset"
 	"github.com/aletheia7/banip/list"
+	"github.com/aletheia7/banip/nft"
 	br "github.com/aletheia7/banip/rbl"
 	"github.com/aletheia7/banip/server/rlog"
+	"github.com/aletheia7/banip/server/rlog/jep"
+	"github.com/aletheia7/banip/source"
+	"github.com/aletheia7/banip/source/stdin"
+	"github.com/aletheia7/banip/source/syslog"
+	"github.com/aletheia7/banip/source/tail"
 	"github.com/aletheia7/gogroup"
 	"github.com/aletheia7/mbus"
 	"github.com/aletheia7/sd/v6"
@@ -32,18 +46,35 @@ import (
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/sys/unix"
 )
 
+// cursor_save is the journal cursor save interval
+const cursor_save = time.Second * 10
+
 var (
-	j         = sd.New()
-	toml_dir  = flag.String("toml", "", "toml directory, default: <user home>/toml")
-	sqlite    = flag.String("sqlite", "banip.sqlite", "if not exist: will be made")
-	nolog     = flag.Bool("nolog", false, "nolog")
-	queue_id  = flag.Uint("queue", 77, "queue id 16 bit, needs to match nfttables rule queue num")
-	ban_dur   = flag.Duration("bdur", time.Duration(time.Hour*24*7), "ban duration, default: 7 days")
-	stats_dur = flag.Duration("stats", time.Duration(time.Hour), "stats dur, default: hourly")
-	rlog_mode = flag.Bool(`rlog`, false, `read journal, populate rlog table, blacklist IP based on rlog reject`)
-	rlog_in   = flag.String(`rlog-in`, `journal:`, `url,  use journal: | file:///<path to journal json file>`)
+	j           = sd.New()
+	toml_dir    = flag.String("toml", "", "toml directory, default: <user home>/toml")
+	sqlite      = flag.String("sqlite", "banip.sqlite", "if not exist: will be made")
+	nolog       = flag.Bool("nolog", false, "nolog")
+	queue_id    = flag.Uint("queue", 77, "queue id 16 bit, needs to match nfttables rule queue num")
+	ban_dur     = flag.Duration("bdur", time.Duration(time.Hour*24*7), "ban duration, default: 7 days")
+	ban_steps   = flag.String("bsteps", "", "escalating ban durations by ban count, comma separated, last repeats, 0: permanent. example: 1h,24h,168h,0. default: -bdur")
+	nf_dur      = flag.Duration("nf-bdur", 0, "nf mode ban duration, escalated by -bsteps, default: -bdur")
+	rlog_dur    = flag.Duration("rlog-bdur", 0, "rlog mode ban duration, escalated by -bsteps, default: -bdur")
+	nft_fam     = flag.String("nft-family", "inet", "nft table family w/ -fw nft: ip, ip6 or inet")
+	nft_table   = flag.String("nft-table", "banip", "nft table w/ -fw nft, owned by banip: replaced at start")
+	nft_set     = flag.String("nft-set", "banip", "nft set w/ -fw nft, IPv6 set: <set>6")
+	nft_prio    = flag.Int("nft-priority", -10, "nft input chain hook priority w/ -fw nft, filter: 0")
+	ipset_set   = flag.String("ipset-set", "banip", "ipset hash:net set w/ -fw ipset, IPv6 set: <set>6")
+	ipset_cmd   = flag.String("ipset-iptables", "iptables", "iptables command w/ -fw ipset, i.e. iptables-legacy, ip6tables is derived")
+	ipset_chain = flag.String("ipset-chain", "INPUT", "iptables chain of the drop rules w/ -fw ipset")
+	fw_file     = flag.String("fw-file", "banip.deny", "deny list file w/ -fw file, replaced atomically, relative to <user home>/db")
+	ctl_sock    = flag.String("ctl", "banip.sock", "admin control unix socket, relative to <user home>/db")
+	fw_recon    = flag.Duration("fw-reconcile", time.Minute*5, "reconcile firewall with blacklist interval w/ -fw, 0: off")
+	stats_dur   = flag.Duration("stats", time.Duration(time.Hour), "stats dur, default: hourly")
+	rlog_mode   = flag.Bool(`rlog`, false, `read journal, populate rlog table, blacklist IP based on rlog reject`)
+	rlog_in     = flag.String(`rlog-in`, `journal:`, `url,  use journal: | file:///<path to journal json file>`)
 )
 
 const tsfmt = `2006-01-02 15:04:05-07:00`
@@ -56,8 +87,19 @@ type Server struct {
 	db             *sql.DB
 	rbl            *br.Search
 	rbls           []string
+	stats_mu       sync.Mutex
 	stats          stat
 	ins_ip, upd_ip *sql.Stmt
+	upd_exp        *sql.Stmt
+	steps          list.Steps
+	strike_mu      sync.Mutex
+	// Serializes the check-then-insert of Bl, Bl_update_ts, Wl, Rm and
+	// Reconcile. Called by ctl, nf, syn, rlog and the filters.
+	list_mu sync.Mutex
+	// Ct: strikes, Ts: last strike
+	strikes map[string]list.Entry
+	// nil without a firewall driver
+	fw fw.Driver
 	// cnew              chan *new_con
 }
 
@@ -67,26 +109,42 @@ type stat struct {
 
 func New(gg *gogroup.Group, home string, rbls []string) *Server {
 	o := &Server{
-		gg:   gg,
-		home: home,
-		wb:   list.New(),
-		db:   get_database(gg, home),
-		rbl:  br.New(gg, rbls),
-		rbls: rbls,
+		gg:      gg,
+		home:    home,
+		wb:      list.New(),
+		db:      get_database(gg, home),
+		rbl:     br.New(gg, rbls),
+		rbls:    rbls,
+		steps:   list.Steps{*ban_dur},
+		strikes: map[string]list.Entry{},
+	}
+	var err error
+	if 0 < len(*ban_steps) {
+		if o.steps, err = list.Parse_steps(*ban_steps); err != nil {
+			j.Err("bsteps:", err)
+			gg.Cancel()
+			return o
+		}
 	}
 	if o.db == nil {
 		return o
 	}
-	var err error
-	if o.ins_ip, err = o.db.PrepareContext(o.gg, "insert or ignore into ip(ip, ban, ts, toml, rbl, log) values(:ip, 1, :ts, :toml, :rbl, :log)"); err != nil {
+	// A re-ban of an expired IP increments ct. Whitelisted IPs are not updated.
+	if o.ins_ip, err = o.db.PrepareContext(o.gg, `insert into ip(ip, ban, ts, toml, rbl, log, fields, ct) values(:ip, 1, :ts, :toml, :rbl, :log, :fields, 1)
+	on conflict(ip) do update set ts = excluded.ts, toml = excluded.toml, rbl = excluded.rbl, log = excluded.log, fields = excluded.fields, ct = ip.ct + 1 where ip.ban = 1
+	returning oid, ct`); err != nil {
+		j.Err(err)
+		return o
+	}
+	if o.upd_ip, err = o.db.PrepareContext(o.gg, "update ip set ts = :ts, exp = :exp where ip = :ip"); err != nil {
 		j.Err(err)
 		return o
 	}
-	if o.upd_ip, err = o.db.PrepareContext(o.gg, "update ip set ts = :ts where ip = :ip"); err != nil {
+	if o.upd_exp, err = o.db.PrepareContext(o.gg, "update ip set exp = :exp where oid = :oid"); err != nil {
 		j.Err(err)
 		return o
 	}
-	rows, err := o.db.QueryContext(o.gg, "select ip, ban, ts from ip")
+	rows, err := o.db.QueryContext(o.gg, "select ip, ban, ts, ct, exp from ip")
 	if err != nil {
 		j.Err(err)
 		return o
@@ -97,14 +155,16 @@ func New(gg *gogroup.Group, home string, rbls []string) *Server {
 		ip     string
 		ban    int
 		ts     time.Time
+		ct     int
+		exp    sql.NullTime
 	)
 	for rows.Next() {
-		if err = rows.Scan(&ip, &ban, (*Stime)(&ts)); err != nil {
+		if err = rows.Scan(&ip, &ban, (*Stime)(&ts), &ct, &exp); err != nil {
 			j.Err(err)
 			return o
 		}
-		// only expire blacklist
-		if ban == 1 && ts.Add(*ban_dur).Before(now) {
+		// only expire blacklist, exp null: permanent
+		if ban == 1 && exp.Valid && exp.Time.Before(now) {
 			exp_ct++
 			continue
 		}
@@ -112,13 +172,13 @@ func New(gg *gogroup.Group, home string, rbls []string) *Server {
 		case ban == 0:
 			o.wb.W.Add(ip)
 		case !o.wb.W.Lookup(net.ParseIP(ip)):
-			o.wb.B.Add(ip, &ts)
+			o.wb.B.Add(ip, list.Entry{Ts: ts, Ct: ct, Exp: exp.Time})
 		}
 	}
 	if err = rows.Err(); err != nil {
 		j.Err(err)
 	}
-	j.Info("ban duration:", *ban_dur)
+	j.Info("ban duration:", o.steps)
 	j.Info("whitelist:", o.wb.W.Len())
 	j.Info("blacklist:", o.wb.B.Len())
 	j.Info("expired:", exp_ct)
@@ -131,19 +191,241 @@ func (o *Server) WB() *list.WB {
 
 var run_once sync.Once
 
-func (o *Server) Run(since string, nf_mode bool) {
+// driver: nft, ipset or file, blacklist is synced to the firewall driver.
+// Filter and rlog bans are enforced without nf_mode.
+func (o *Server) Run(since string, nf_mode bool, driver string) {
 	run_once.Do(func() {
-		if nf_mode {
-			if *rlog_mode {
-				go o.run_rlog()
+		if 0 < len(driver) {
+			if err := o.start_fw(driver); err != nil {
+				j.Err(err)
+				o.gg.Cancel()
+				return
 			}
+		}
+		if *rlog_mode {
+			go o.run_rlog()
+		}
+		go o.expire()
+		if 0 < len(driver) {
+			go o.reconcile()
+		}
+		if nf_mode {
 			go o.run_nf()
 		} else {
-			o.run(since)
+			go o.run(since)
 		}
 	})
 }
 
+// open_fw returns a firewall driver. existing: use the nft table of a running
+// banip instead of replacing it.
+func (o *Server) open_fw(driver string, existing bool) (fw.Driver, error) {
+	switch driver {
+	case `nft`:
+		var (
+			t   *nft.Table
+			err error
+		)
+		if existing {
+			t, err = nft.Open_table(*nft_fam, *nft_table, *nft_set, nft.Priority(*nft_prio))
+		} else {
+			t, err = nft.New_table(*nft_fam, *nft_table, *nft_set, nft.Priority(*nft_prio))
+		}
+		if err != nil {
+			return nil, err
+		}
+		return t, nil
+	case `ipset`:
+		s, err := ipset.New(*ipset_set, ipset.Iptables(*ipset_cmd), ipset.Chain(*ipset_chain))
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case `file`:
+		p := *fw_file
+		if !path.IsAbs(p) {
+			p = path.Join(o.home, `db`, p)
+		}
+		l, err := file.New(p)
+		if err != nil {
+			return nil, err
+		}
+		return l, nil
+	}
+	return nil, fmt.Errorf("invalid firewall driver: %v, use: nft, ipset or file", driver)
+}
+
+func (o *Server) start_fw(driver string) error {
+	j.Info("firewall:", driver)
+	d, err := o.open_fw(driver, false)
+	if err != nil {
+		return err
+	}
+	o.fw = d
+	now := time.Now()
+	a := make([]fw.Element, 0, o.wb.B.Len())
+	for ip, e := range o.wb.B.Entries() {
+		if el, ok := fw_element(ip, e, now); ok && !o.wb.B.Covered(ip) {
+			a = append(a, el)
+		}
+	}
+	o.fw_replace(nil, a)
+	j.Info("firewall elements:", len(a))
+	return nil
+}
+
+func (o *Server) reconcile() {
+	if *fw_recon <= 0 {
+		return
+	}
+	key := o.gg.Register()
+	defer o.gg.Unregister(key)
+	t := time.NewTicker(*fw_recon)
+	defer t.Stop()
+	for {
+		select {
+		case <-o.gg.Done():
+			return
+		case <-t.C:
+			if err := o.Reconcile(``); err != nil {
+				j.Warning("reconcile:", err)
+			}
+		}
+	}
+}
+
+// Reconcile diffs the firewall driver elements against the blacklist. Missing
+// entries are added, expired and unbanned entries are removed. A flushed nft
+// table is remade. driver is used when not running: the nft table of a
+// running banip is used, or made.
+func (o *Server) Reconcile(driver string) error {
+	o.list_mu.Lock()
+	defer o.list_mu.Unlock()
+	if o.fw == nil {
+		d, err := o.open_fw(driver, true)
+		if err != nil {
+			if driver != `nft` {
+				return err
+			}
+			// No table
+			j.Warning(err)
+			return o.start_fw(driver)
+		}
+		o.fw = d
+	}
+	// Read the driver before the blacklist: a concurrent ban is not removed
+	a, err := o.fw.List()
+	if err != nil {
+		r, ok := o.fw.(interface{ Reset() error })
+		if !ok {
+			return err
+		}
+		j.Warning("firewall:", err, "remaking table")
+		if err = r.Reset(); err != nil {
+			return err
+		}
+		a = []fw.Element{}
+	}
+	in_fw := make(map[string]bool, len(a))
+	for _, el := range a {
+		in_fw[el.Ip] = true
+	}
+	now := time.Now()
+	want := map[string]bool{}
+	add := []fw.Element{}
+	for ip, e := range o.wb.B.Entries() {
+		// An IP inside a banned network overlaps, i.e. from an older database
+		if el, ok := fw_element(ip, e, now); ok && !o.wb.B.Covered(ip) {
+			want[ip] = true
+			if !in_fw[ip] {
+				add = append(add, el)
+			}
+		}
+	}
+	rm := []string{}
+	for ip := range in_fw {
+		if !want[ip] {
+			rm = append(rm, ip)
+		}
+	}
+	o.fw_replace(rm, add)
+	if 0 < len(add) || 0 < len(rm) {
+		j.Warningf("reconcile drift: firewall: %v, blacklist: %v, added: %v, removed: %v", len(in_fw), len(want), len(add), len(rm))
+	} else {
+		j.Infof("reconcile: firewall: %v, blacklist: %v", len(in_fw), len(want))
+	}
+	return nil
+}
+
+// ok is false when e has expired
+func fw_element(ip string, e list.Entry, now time.Time) (el fw.Element, ok bool) {
+	el.Ip = ip
+	if !e.Exp.IsZero() {
+		if el.Timeout = e.Exp.Sub(now); el.Timeout <= 0 {
+			return
+		}
+	}
+	return el, true
+}
+
+func (o *Server) fw_add(ip string, e list.Entry) {
+	if o.fw == nil {
+		return
+	}
+	if el, ok := fw_element(ip, e, time.Now()); ok {
+		if err := o.fw.Add(el); err != nil {
+			j.Warning(err)
+		}
+	}
+}
+
+// fw_refresh replaces the element timeout without a window where ip is not
+// dropped. Drivers without fw.Refresher update with Add.
+func (o *Server) fw_refresh(ip string, e list.Entry) {
+	if o.fw == nil {
+		return
+	}
+	r, ok := o.fw.(fw.Refresher)
+	if !ok {
+		o.fw_add(ip, e)
+		return
+	}
+	if el, ok := fw_element(ip, e, time.Now()); ok {
+		if err := r.Refresh(el); err != nil {
+			j.Warning(err)
+		}
+	}
+}
+
+// fw_replace removes rm before adding a, in one batch with fw.Replacer: a
+// network is not added over the elements inside it
+func (o *Server) fw_replace(rm []string, a []fw.Element) {
+	if o.fw == nil || len(rm) == 0 && len(a) == 0 {
+		return
+	}
+	if r, ok := o.fw.(fw.Replacer); ok {
+		if err := r.Replace(rm, a...); err != nil {
+			j.Warning(err)
+		}
+		return
+	}
+	o.fw_remove(rm...)
+	if 0 < len(a) {
+		if err := o.fw.Add(a...); err != nil {
+			j.Warning(err)
+		}
+	}
+}
+
+func (o *Server) fw_remove(ip ...string) {
+	if o.fw == nil || len(ip) == 0 {
+		return
+	}
+	if err := o.fw.Remove(ip...); err != nil {
+		j.Warning(err)
+	}
+}
+
 func (o *Server) run_rlog() {
 	key := o.gg.Register()
 	defer o.gg.Unregister(key)
@@ -291,7 +573,7 @@ values(
 			if o.wb.B.Lookup(l.Ip) {
 				o.Bl_update_ts(l.Ip.String(), l.T)
 			} else {
-				o.Bl(l.Ip.String(), `rlog`, ``, ``, l.T)
+				o.Bl(l.Ip.String(), `rlog`, ``, ``, nil, l.T, *rlog_dur)
 			}
 		}
 	}
@@ -301,7 +583,6 @@ func (o *Server) run_nf() {
 	key := o.gg.Register()
 	defer o.gg.Unregister(key)
 	j.Info("mode: nf")
-	go o.expire()
 	var nf *nfqueue.Nfqueue
 	var err error
 	if nf, err = nfqueue.Open(&nfqueue.Config{
@@ -319,18 +600,44 @@ func (o *Server) run_nf() {
 			j.Err("nf.close:", err)
 		}
 	}()
-	var ip4 layers.IPv4
-	parser := gopacket.NewDecodingLayerParser(layers.LayerTypeIPv4)
-	parser.SetDecodingLayerContainer(gopacket.DecodingLayerSparse(nil))
-	parser.AddDecodingLayer(&ip4)
-	parser.IgnoreUnsupported = true
+	var (
+		ip4 layers.IPv4
+		ip6 layers.IPv6
+		src net.IP
+	)
+	parser4 := gopacket.NewDecodingLayerParser(layers.LayerTypeIPv4)
+	parser4.SetDecodingLayerContainer(gopacket.DecodingLayerSparse(nil))
+	parser4.AddDecodingLayer(&ip4)
+	parser4.IgnoreUnsupported = true
+	parser6 := gopacket.NewDecodingLayerParser(layers.LayerTypeIPv6)
+	parser6.SetDecodingLayerContainer(gopacket.DecodingLayerSparse(nil))
+	parser6.AddDecodingLayer(&ip6)
+	parser6.IgnoreUnsupported = true
 	decoded := []gopacket.LayerType{}
 	if err = nf.Register(o.gg, func(a nfqueue.Attribute) int {
-		if err = parser.DecodeLayers(*a.Payload, &decoded); err != nil {
+		if a.Payload == nil || len(*a.Payload) == 0 {
+			return 0
+		}
+		// IP version nibble
+		switch (*a.Payload)[0] >> 4 {
+		case 4:
+			err = parser4.DecodeLayers(*a.Payload, &decoded)
+			src = ip4.SrcIP
+		case 6:
+			err = parser6.DecodeLayers(*a.Payload, &decoded)
+			src = ip6.SrcIP
+		default:
+			err = fmt.Errorf("unknown ip version: %v", (*a.Payload)[0]>>4)
+		}
+		if err != nil {
 			j.Err("DecodeLayers err", err)
 			return 0
 		}
-		o.stats.con++
+		// IPv4-mapped IPv6 as IPv4
+		if v4 := src.To4(); v4 != nil {
+			src = v4
+		}
+		o.count(&o.stats.con)
 		select {
 		case <-o.gg.Done():
 			if err = nf.SetVerdict(*a.PacketID, nfqueue.NfAccept); err != nil {
@@ -339,31 +646,31 @@ func (o *Server) run_nf() {
 			return 1
 		default:
 			switch {
-			case o.wb.W.Lookup(ip4.SrcIP):
+			case o.wb.W.Lookup(src):
 				if err = nf.SetVerdict(*a.PacketID, nfqueue.NfAccept); err != nil {
 					j.Warning(err)
 				}
-				o.stats.wl++
-			case o.wb.B.Lookup(ip4.SrcIP):
+				o.count(&o.stats.wl)
+			case o.wb.B.Lookup(src):
 				if err = nf.SetVerdict(*a.PacketID, nfqueue.NfDrop); err != nil {
 					j.Warning(err)
 				}
-				ip := ip4.SrcIP.To4().String()
+				ip := src.String()
 				id, updated := o.Bl_update_ts(ip, time.Now())
 				if updated {
 					if !*nolog {
 						j.Infof("blacklist update: nf %v %v", id, ip)
 					}
 				}
-				o.stats.bl++
+				o.count(&o.stats.bl)
 			default:
-				if aa := o.rbl.Lookup(ip4.SrcIP, true); 0 < len(aa) {
+				if aa := o.rbl.Lookup(src, true); 0 < len(aa) {
 					if err = nf.SetVerdict(*a.PacketID, nfqueue.NfDrop); err != nil {
 						j.Warning(err)
 					}
-					o.stats.banned++
-					ip := ip4.SrcIP.To4().String()
-					id := o.Bl(ip, `nf`, aa[0], nil, time.Now())
+					o.count(&o.stats.banned)
+					ip := src.String()
+					id := o.Bl(ip, `nf`, aa[0], nil, nil, time.Now(), *nf_dur)
 					if !*nolog {
 						j.Infof("blacklist: nf %v %v %v", id, ip, aa[0])
 					}
@@ -371,7 +678,7 @@ func (o *Server) run_nf() {
 					if err = nf.SetVerdict(*a.PacketID, nfqueue.NfAccept); err != nil {
 						j.Warning(err)
 					}
-					o.stats.accept++
+					o.count(&o.stats.accept)
 				}
 			}
 		}
@@ -386,19 +693,41 @@ func (o *Server) run_nf() {
 	<-o.gg.Done()
 }
 
+func (o *Server) count(n *int) {
+	o.stats_mu.Lock()
+	*n++
+	o.stats_mu.Unlock()
+}
+
+// stats_reset returns the counters and zeroes them
+func (o *Server) stats_reset() stat {
+	o.stats_mu.Lock()
+	defer o.stats_mu.Unlock()
+	st := o.stats
+	o.stats = stat{}
+	return st
+}
+
 func (o *Server) expire() {
 	key := o.gg.Register()
 	defer o.gg.Unregister(key)
+	stats := time.NewTicker(*stats_dur)
+	defer stats.Stop()
+	expire := time.NewTicker(time.Hour)
+	defer expire.Stop()
 	for {
 		select {
 		case <-o.gg.Done():
 			return
-		case <-time.After(*stats_dur):
-			j.Infof("new cons: %v, new bans: %v, wl: %v, bl: %v, accept: %v\n", o.stats.con, o.stats.banned, o.stats.wl, o.stats.bl, o.stats.accept)
-			o.stats = stat{}
-		case <-time.After(time.Hour):
+		case <-stats.C:
+			st := o.stats_reset()
+			j.Infof("new cons: %v, new bans: %v, wl: %v, bl: %v, accept: %v\n", st.con, st.banned, st.wl, st.bl, st.accept)
+		case <-expire.C:
 			j.Info("begin expire:", o.wb.B.Len())
-			j.Info("end expire:", o.wb.B.Expire(*ban_dur))
+			// nft removes elements by timeout, remove stragglers
+			o.fw_remove(o.wb.B.Expire()...)
+			o.expire_strikes(time.Now())
+			j.Info("end expire:", o.wb.B.Len())
 		}
 	}
 }
@@ -408,42 +737,228 @@ func (o *Server) run(since string) {
 	defer o.gg.Unregister(key)
 	bus := mbus.New_bus(o.gg, j)
 	c := make(chan *mbus.Msg, 256)
-	bus.Subscribe(c, filter.T_bl)
-	defer bus.Unsubscribe(c, filter.T_bl)
-	o.run_filter(bus, since)
+	topics := []string{filter.T_bl, filter.T_wl, filter.T_log, filter.T_strike, filter.T_rbl}
+	bus.Subscribe(c, topics...)
+	defer bus.Unsubscribe(c, topics...)
+	fs := o.new_filters(bus)
+	fs.load(since)
+	changed := make(chan struct{}, 1)
+	if err := watch(o.gg, filepath.Dir(fs.glob), changed); err != nil {
+		j.Warning("toml watch:", err)
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	// Editors write a file in steps
+	var settle <-chan time.Time
 	for {
 		select {
 		case <-o.gg.Done():
+			return
+		case <-changed:
+			settle = time.After(time.Second)
+		case <-settle:
+			settle = nil
+			fs.load(``)
+		case <-hup:
+			j.Info("SIGHUP: reloading filters")
+			fs.load(``)
 		case in := <-c:
-			switch in.Topic {
-			case filter.T_bl:
-				if a, ok := in.Data.(*filter.Action); ok {
-					ip := net.ParseIP(a.Ip).To4()
-					if ip != nil {
-						j.Warning("invalid ip:", a.Ip)
-						return
-					}
-					switch {
-					case o.wb.W.Lookup(ip) || o.wb.B.Lookup(ip):
-					default:
-						var rbl_found interface{}
-						if a.Check_rbl {
-							if a := o.rbl.Lookup(ip, true); 0 < len(a) {
-								rbl_found = a[0]
-							}
-						}
-						id := o.Bl(a.Ip, a.Toml, rbl_found, a.Msg, time.Now())
-						if !*nolog {
-							j.Infof("blacklist: %v %v %v %v", a.Toml, id, a.Ip, rbl_found)
-						}
-					}
-				}
+			if a, ok := in.Data.(*filter.Action); ok {
+				o.action(in.Topic, a)
+			}
+		}
+	}
+}
+
+// Reasons of plan for no action
+const (
+	why_invalid     = `invalid ip`
+	why_whitelisted = `whitelisted`
+	why_blacklisted = `blacklisted`
+	why_not_listed  = `not on an rbl`
+)
+
+// plan returns the action of a filter action: filter.T_wl, filter.T_bl,
+// filter.T_strike, filter.T_log, or empty with the reason. rbl is the rbl
+// listing the IP.
+func (o *Server) plan(topic string, a *filter.Action) (do, why string, rbl interface{}) {
+	ip := net.ParseIP(a.Ip)
+	switch {
+	case ip == nil:
+		return ``, why_invalid, nil
+	case o.wb.W.Lookup(ip):
+		return ``, why_whitelisted, nil
+	case topic == filter.T_wl:
+		return filter.T_wl, ``, nil
+	case o.wb.B.Lookup(ip):
+		return ``, why_blacklisted, nil
+	}
+	switch topic {
+	case filter.T_bl:
+		if a.Rbl != nil {
+			rbl = a.Rbl
+		} else if a.Check_rbl {
+			if l := o.rbl.Lookup(ip, true); 0 < len(l) {
+				rbl = l[0]
 			}
 		}
+		return filter.T_bl, ``, rbl
+	case filter.T_rbl:
+		rbl = a.Rbl
+		if rbl == nil {
+			if l := o.rbl.Lookup(ip, true); 0 < len(l) {
+				rbl = l[0]
+			}
+		}
+		if rbl == nil {
+			return ``, why_not_listed, nil
+		}
+		return filter.T_bl, ``, rbl
+	}
+	return topic, ``, nil
+}
+
+// action runs a filter action, topic: filter.T_*
+func (o *Server) action(topic string, a *filter.Action) {
+	do, why, rbl_found := o.plan(topic, a)
+	switch do {
+	case ``:
+		switch {
+		case why == why_invalid:
+			j.Warning("invalid ip:", a.Ip)
+		case why == why_not_listed && !*nolog:
+			j.Infof("rbl: %v %v not listed", a.Toml, a.Ip)
+		}
+	case filter.T_wl:
+		o.Wl(a.Ip)
+		if !*nolog {
+			j.Infof("whitelist: %v %v", a.Toml, a.Ip)
+		}
+	case filter.T_bl:
+		id := o.Bl(a.Ip, a.Toml, rbl_found, a.Msg, fields(a.Fields), time.Now(), a.Ban_duration)
+		if !*nolog {
+			j.Infof("blacklist: %v %v %v %v", a.Toml, id, a.Ip, rbl_found)
+		}
+	case filter.T_strike:
+		ct := o.strike(a.Ip, time.Now())
+		if !*nolog {
+			j.Infof("strike: %v %v ct: %v", a.Toml, a.Ip, ct)
+		}
+	case filter.T_log:
+		j.Infof("log: %v %v %v", a.Toml, a.Ip, a.Msg)
+	}
+}
+
+// Explain returns the decision path of a log line through the toml filters,
+// tag: the syslog identifier, empty: any. Nothing is banned.
+func (o *Server) Explain(tag, msg string) (out []string) {
+	toml, err := filepath.Glob(o.toml_glob())
+	if err != nil {
+		return []string{err.Error()}
+	}
+	actions := []string{}
+	for _, p := range toml {
+		if filepath.Base(p) == filter.Vars_file {
+			continue
+		}
+		f, err := filter.Load(p)
+		if err != nil {
+			out = append(out, fmt.Sprintf("%v: %v", p, err))
+			continue
+		}
+		if !f.Enabled {
+			out = append(out, fmt.Sprintf("%v: disabled", f.Name))
+			continue
+		}
+		steps, r, ok := f.Explain(tag, msg)
+		for _, s := range steps {
+			out = append(out, fmt.Sprintf("%v: %v", f.Name, s))
+		}
+		if !ok || r.Verdict != filter.Matched {
+			continue
+		}
+		ip := net.ParseIP(r.Ip)
+		if e, en, found := o.wb.B.Match(ip); found {
+			out = append(out, fmt.Sprintf("%v: blacklist: %v ct: %v exp: %v", f.Name, e, en.Ct, en.Exp))
+		} else {
+			out = append(out, fmt.Sprintf("%v: blacklist: no", f.Name))
+		}
+		if o.wb.W.Lookup(ip) {
+			out = append(out, fmt.Sprintf("%v: whitelist: yes", f.Name))
+		} else {
+			out = append(out, fmt.Sprintf("%v: whitelist: no", f.Name))
+		}
+		if 1 < f.Maxretry {
+			out = append(out, fmt.Sprintf("%v: maxretry: %v within %v, the action runs on match %v", f.Name, f.Maxretry, f.Findtime, f.Maxretry))
+		}
+		a := &filter.Action{Toml: f.Name, Ip: r.Ip, Msg: msg, Fields: r.Fields, Check_rbl: f.Rbl_use, Ban_duration: f.Ban_duration}
+		if f.Rbl_must {
+			if l := o.rbl.Lookup(ip, true); 0 < len(l) {
+				a.Rbl = l[0]
+				out = append(out, fmt.Sprintf("%v: rbl_must: %v", f.Name, l[0]))
+			} else {
+				out = append(out, fmt.Sprintf("%v: rbl_must: not listed", f.Name))
+				actions = append(actions, fmt.Sprintf("%v: none, rbl_must: not listed", f.Name))
+				continue
+			}
+		}
+		do, why, rbl_found := o.plan(f.Topic(), a)
+		switch do {
+		case ``:
+			actions = append(actions, fmt.Sprintf("%v: none, %v %v", f.Name, r.Ip, why))
+		case filter.T_bl:
+			out = append(out, fmt.Sprintf("%v: rbl: %v", f.Name, rbl_found))
+			// A repeat ban escalates by -bsteps
+			var ct int
+			switch err := o.db.QueryRowContext(o.gg, "select ct from ip where ip = :ip and ban = 1", sql.Named("ip", ip.String())).Scan(&ct); err {
+			case nil:
+			case sql.ErrNoRows:
+				// first ban
+			default:
+				j.Err(err)
+			}
+			actions = append(actions, fmt.Sprintf("%v: blacklist %v ct: %v dur: %v", f.Name, r.Ip, ct+1, o.steps.Scale(ct+1, a.Ban_duration)))
+		case filter.T_wl:
+			actions = append(actions, fmt.Sprintf("%v: whitelist %v", f.Name, r.Ip))
+		default:
+			actions = append(actions, fmt.Sprintf("%v: %v %v", f.Name, do, r.Ip))
+		}
+	}
+	if len(actions) == 0 {
+		actions = append(actions, `none`)
+	}
+	for _, s := range actions {
+		out = append(out, `action: `+s)
+	}
+	return
+}
+
+// strike counts a strike against ip, returns the strike count
+func (o *Server) strike(ip string, ts time.Time) int {
+	o.strike_mu.Lock()
+	defer o.strike_mu.Unlock()
+	e := o.strikes[ip]
+	e.Ts = ts
+	e.Ct++
+	o.strikes[ip] = e
+	return e.Ct
+}
+
+// Strikes older than -bdur are forgotten
+func (o *Server) expire_strikes(now time.Time) {
+	o.strike_mu.Lock()
+	defer o.strike_mu.Unlock()
+	for ip, e := range o.strikes {
+		if e.Ts.Add(*ban_dur).Before(now) {
+			delete(o.strikes, ip)
+		}
 	}
 }
 
 func (o *Server) Wl(ip string) {
+	o.list_mu.Lock()
+	defer o.list_mu.Unlock()
 	i, err := list.Valid_ip_cidr(ip)
 	if err != nil {
 		j.Err(err)
@@ -463,6 +978,9 @@ func (o *Server) Wl(ip string) {
 	}
 	if !present {
 		o.wb.W.Add(s)
+		// replace deletes a blacklist row
+		o.wb.B.Remove(s)
+		o.fw_remove(s)
 		if _, err := o.db.ExecContext(o.gg, "replace into ip(ip, ban, ts, toml) values(:ip, 0, :ts, null)", sql.Named("ip", s), sql.Named("ts", time.Now().Format(tsfmt))); err != nil {
 			j.Err(err)
 		}
@@ -470,16 +988,29 @@ func (o *Server) Wl(ip string) {
 }
 
 func (o *Server) Q(ip string) {
+	out, err := o.q(ip)
+	if err != nil {
+		j.Err(err)
+		return
+	}
+	for _, s := range out {
+		j.Info(s)
+	}
+}
+
+// q returns the sqlite row of ip as lines, none when not found
+func (o *Server) q(ip string) (out []string, err error) {
 	var (
 		oid            int64
 		ban            bool
 		ts             time.Time
+		ct             int
+		exp            sql.NullTime
 		toml, log, rbl sql.NullString
 	)
 	i, err := list.Valid_ip_cidr(ip)
 	if err != nil {
-		j.Err(err)
-		return
+		return nil, err
 	}
 	var s string
 	switch t := i.(type) {
@@ -488,33 +1019,178 @@ func (o *Server) Q(ip string) {
 	case *net.IPNet:
 		s = t.String()
 	default:
-		j.Err("unknown value:", i)
-		return
+		return nil, fmt.Errorf("unknown value: %v", i)
 	}
-	err = o.db.QueryRowContext(o.gg, "select oid, ban, ts, toml, log, rbl from ip where ip = :ip order by ban limit 1", sql.Named("ip", s)).Scan(&oid, &ban, (*Stime)(&ts), &toml, &log, &rbl)
+	err = o.db.QueryRowContext(o.gg, "select oid, ban, ts, ct, exp, toml, log, rbl from ip where ip = :ip order by ban limit 1", sql.Named("ip", s)).Scan(&oid, &ban, (*Stime)(&ts), &ct, &exp, &toml, &log, &rbl)
 	switch err {
 	case sql.ErrNoRows:
-		return
+		return nil, nil
 	case nil:
 	default:
-		j.Err(err)
-		return
+		return nil, err
+	}
+	out = append(out,
+		fmt.Sprint("oid: ", oid),
+		fmt.Sprint("ban: ", ban),
+		fmt.Sprint("ts: ", ts.Format("2006-01-02 15:04:05")),
+	)
+	if ban {
+		out = append(out, fmt.Sprint("ct: ", ct))
+		if exp.Valid {
+			out = append(out, fmt.Sprint("expires: ", exp.Time.Local().Format("2006-01-02 15:04:05")))
+		} else {
+			out = append(out, "expires: never")
+		}
 	}
-	j.Info("oid:", oid)
-	j.Info("ban:", ban)
-	j.Info("ts:", ts.Format("2006-01-02 15:04:05"))
 	if toml.Valid {
-		j.Info("toml:", toml.String)
+		out = append(out, fmt.Sprint("toml: ", toml.String))
 	}
 	if log.Valid {
-		j.Info("log:", log.String)
+		out = append(out, fmt.Sprint("log: ", log.String))
 	}
 	if rbl.Valid {
-		j.Info("rbl:", rbl.String)
+		out = append(out, fmt.Sprint("rbl: ", rbl.String))
+	}
+	return out, nil
+}
+
+// List returns the in memory blacklist, whitelist and strikes as lines
+func (o *Server) List() []string {
+	e := o.wb.B.Entries()
+	b := make([]string, 0, len(e))
+	for ip := range e {
+		b = append(b, ip)
+	}
+	sort.Strings(b)
+	w := o.wb.W.All()
+	sort.Strings(w)
+	out := make([]string, 0, len(b)+len(w))
+	for _, ip := range b {
+		exp := `never`
+		if !e[ip].Exp.IsZero() {
+			exp = e[ip].Exp.Local().Format("2006-01-02 15:04:05")
+		}
+		out = append(out, fmt.Sprintf("bl %v ct: %v expires: %v", ip, e[ip].Ct, exp))
 	}
+	for _, ip := range w {
+		out = append(out, "wl "+ip)
+	}
+	o.strike_mu.Lock()
+	st := make([]string, 0, len(o.strikes))
+	for ip, e := range o.strikes {
+		st = append(st, fmt.Sprintf("strike %v ct: %v", ip, e.Ct))
+	}
+	o.strike_mu.Unlock()
+	sort.Strings(st)
+	return append(out, st...)
 }
 
-func (o *Server) Bl(ip, toml string, rbl, log interface{}, ts time.Time) (last_insert_id int64) {
+// Stats returns the counters since the last -stats log and list sizes
+func (o *Server) Stats() []string {
+	o.stats_mu.Lock()
+	st := o.stats
+	o.stats_mu.Unlock()
+	o.strike_mu.Lock()
+	strikes := len(o.strikes)
+	o.strike_mu.Unlock()
+	return []string{
+		fmt.Sprintf("new cons: %v, new bans: %v, wl: %v, bl: %v, accept: %v", st.con, st.banned, st.wl, st.bl, st.accept),
+		fmt.Sprintf("whitelist: %v, blacklist: %v, strikes: %v", o.wb.W.Len(), o.wb.B.Len(), strikes),
+	}
+}
+
+func ctl_path(home string) string {
+	if path.IsAbs(*ctl_sock) {
+		return *ctl_sock
+	}
+	return path.Join(home, `db`, *ctl_sock)
+}
+
+// Listen serves the admin control socket, see -ctl
+func (o *Server) Listen() error {
+	p := ctl_path(o.home)
+	if err := ctl.Listen(o.gg, p, o.handle); err != nil {
+		return err
+	}
+	j.Info("ctl:", p)
+	return nil
+}
+
+func (o *Server) handle(r *ctl.Request) *ctl.Response {
+	res := &ctl.Response{}
+	switch r.Cmd {
+	case ctl.Bl, ctl.Wl, ctl.Rm, ctl.Q:
+		if _, err := list.Valid_ip_cidr(r.Ip); err != nil {
+			res.Err = err.Error()
+			return res
+		}
+	}
+	switch r.Cmd {
+	case ctl.Bl:
+		switch id := o.Bl(r.Ip, "blip", nil, nil, nil, time.Now(), r.Dur); id {
+		case -1:
+			res.Out = []string{"present or whitelisted: " + r.Ip}
+		case 0:
+			res.Err = "blacklist failed, see daemon log: " + r.Ip
+		default:
+			res.Out = []string{fmt.Sprint("blacklist: ", id, " ", r.Ip)}
+		}
+	case ctl.Wl:
+		o.Wl(r.Ip)
+		res.Out = []string{"whitelist: " + r.Ip}
+	case ctl.Rm:
+		o.Rm(r.Ip)
+		res.Out = []string{"removed: " + r.Ip}
+	case ctl.Q:
+		out, err := o.q(r.Ip)
+		if err != nil {
+			res.Err = err.Error()
+		}
+		res.Out = out
+	case ctl.List:
+		res.Out = o.List()
+	case ctl.Stats:
+		res.Out = o.Stats()
+	case ctl.Reconcile:
+		if o.fw == nil {
+			res.Err = "daemon has no -fw driver"
+		} else if err := o.Reconcile(``); err != nil {
+			res.Err = err.Error()
+		} else {
+			res.Out = []string{"reconciled, see daemon log"}
+		}
+	default:
+		res.Err = "unknown command: " + r.Cmd
+	}
+	return res
+}
+
+// Call sends r to a running daemon and logs the response. false: no daemon
+// is running, use the database.
+func Call(home string, r *ctl.Request) bool {
+	res, err := ctl.Call(ctl_path(home), r)
+	switch err {
+	case nil:
+	case ctl.Err_no_daemon:
+		return false
+	default:
+		j.Err(err)
+		return true
+	}
+	for _, s := range res.Out {
+		j.Info(s)
+	}
+	if 0 < len(res.Err) {
+		j.Err(res.Err)
+	}
+	return true
+}
+
+// dur: the ban duration of the source, escalated by -bsteps. 0: -bdur
+// fields: JSON of the filter named groups or nil
+func (o *Server) Bl(ip, toml string, rbl, log, fields interface{}, ts time.Time, dur time.Duration) (last_insert_id int64) {
+	o.list_mu.Lock()
+	defer o.list_mu.Unlock()
 	i, err := list.Valid_ip_cidr(ip)
 	if err != nil {
 		j.Err(err)
@@ -522,13 +1198,17 @@ func (o *Server) Bl(ip, toml string, rbl, log interface{}, ts time.Time) (last_i
 	}
 	var s string
 	var present bool
+	// inside: the IPs and smaller networks absorbed by a network ban
+	var inside []string
 	switch t := i.(type) {
 	case *net.IP:
 		s = t.String()
 		present = o.wb.B.Lookup(*t)
 	case *net.IPNet:
-		j.Err("cannot blacklist network:", ip)
-		return
+		s = t.String()
+		if present = o.wb.B.Lookup_net(t); !present {
+			inside = o.wb.B.Inside(t)
+		}
 	default:
 		j.Err("unknown value:", i)
 		return
@@ -536,27 +1216,83 @@ func (o *Server) Bl(ip, toml string, rbl, log interface{}, ts time.Time) (last_i
 	if present {
 		return -1
 	}
-	o.wb.B.Add(ip, &ts)
-	res, err := o.ins_ip.ExecContext(o.gg,
+	var ct int
+	err = o.ins_ip.QueryRowContext(o.gg,
 		sql.Named("ip", s),
 		sql.Named("ts", ts.Format(tsfmt)),
 		sql.Named("toml", toml),
 		sql.Named("rbl", rbl),
 		sql.Named("log", log),
-	)
-	if err != nil {
+		sql.Named("fields", fields),
+	).Scan(&last_insert_id, &ct)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		// whitelisted in sqlite
+		return -1
+	default:
 		j.Err(err)
 		return
 	}
-	last_insert_id, err = res.LastInsertId()
-	if err != nil {
-		j.Warning(err)
+	e := list.Entry{Ts: ts, Ct: ct, Exp: o.steps.Exp(ts, ct, dur)}
+	if _, err = o.upd_exp.ExecContext(o.gg,
+		sql.Named("exp", null_time(e.Exp)),
+		sql.Named("oid", last_insert_id),
+	); err != nil {
+		j.Err(err)
+		return
+	}
+	for _, v := range inside {
+		o.wb.B.Remove(v)
+		if _, err := o.db.ExecContext(o.gg, "delete from ip where ip = :ip and ban = 1", sql.Named("ip", v)); err != nil {
+			j.Err(err)
+		}
+	}
+	if 0 < len(inside) && !*nolog {
+		j.Info("blacklist absorbed:", s, inside)
+	}
+	o.wb.B.Add(s, e)
+	if 0 < len(inside) {
+		a := []fw.Element{}
+		if el, ok := fw_element(s, e, time.Now()); ok {
+			a = append(a, el)
+		}
+		o.fw_replace(inside, a)
+	} else {
+		o.fw_add(s, e)
+	}
+	if 1 < ct && !*nolog {
+		j.Infof("blacklist repeat: %v ct: %v dur: %v", s, ct, o.steps.Scale(ct, dur))
 	}
 	return
 }
 
-// Check ip existence before update
+// fields returns filter.Action.Fields as JSON, nil when empty
+func fields(m map[string]string) interface{} {
+	if len(m) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		j.Err(err)
+		return nil
+	}
+	return string(b)
+}
+
+// nil for permanent
+func null_time(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.Format(tsfmt)
+}
+
+// Check ip existence before update. When ip is inside a blacklisted network
+// the network entry is updated.
 func (o *Server) Bl_update_ts(ip string, ts time.Time) (last_insert_id int64, updated bool) {
+	o.list_mu.Lock()
+	defer o.list_mu.Unlock()
 	i, err := list.Valid_ip_cidr(ip)
 	if err != nil {
 		j.Err(err)
@@ -564,13 +1300,15 @@ func (o *Server) Bl_update_ts(ip string, ts time.Time) (last_insert_id int64, up
 	}
 	var s string
 	var present bool
-	var old_ts *time.Time
+	var old list.Entry
 	switch t := i.(type) {
 	case *net.IP:
-		s = t.String()
-		old_ts, present = o.wb.B.Lookup_all(*t)
+		s, old, present = o.wb.B.Match(*t)
+		if !present {
+			s = t.String()
+		}
 	case *net.IPNet:
-		j.Err("cannot blacklist network:", ip)
+		j.Err("cannot update network, use an IP inside the network:", ip)
 		return
 	default:
 		j.Err("unknown value:", i)
@@ -581,12 +1319,22 @@ func (o *Server) Bl_update_ts(ip string, ts time.Time) (last_insert_id int64, up
 		j.Err("ip should be present:", s)
 		return
 	}
-	if old_ts.Add(time.Minute * 10).After(ts) {
+	if old.Ts.Add(time.Minute * 10).After(ts) {
 		return
 	}
-	o.wb.B.Add(ip, &ts)
+	e := list.Entry{Ts: ts, Ct: old.Ct}
+	// Keep the ban duration, extend from ts
+	if !old.Exp.IsZero() {
+		e.Exp = ts.Add(old.Exp.Sub(old.Ts))
+	}
+	o.wb.B.Add(s, e)
+	// Refresh the firewall timeout
+	if !e.Exp.IsZero() {
+		o.fw_refresh(s, e)
+	}
 	res, err := o.upd_ip.ExecContext(o.gg,
 		sql.Named("ts", ts.Format(tsfmt)),
+		sql.Named("exp", null_time(e.Exp)),
 		sql.Named("ip", s),
 	)
 	if err != nil {
@@ -602,6 +1350,8 @@ func (o *Server) Bl_update_ts(ip string, ts time.Time) (last_insert_id int64, up
 }
 
 func (o *Server) Rm(ip string) {
+	o.list_mu.Lock()
+	defer o.list_mu.Unlock()
 	i, err := list.Valid_ip_cidr(ip)
 	if err != nil {
 		j.Err(err)
@@ -619,53 +1369,339 @@ func (o *Server) Rm(ip string) {
 	}
 	o.wb.W.Remove(s)
 	o.wb.B.Remove(s)
+	o.fw_remove(s)
+	o.strike_mu.Lock()
+	delete(o.strikes, s)
+	o.strike_mu.Unlock()
 	if _, err := o.db.ExecContext(o.gg, "delete from ip where ip = :ip", sql.Named("ip", s)); err != nil {
 		j.Err(err)
 	}
 }
 
-func (o *Server) run_filter(bus *mbus.Bus, since string) {
-	td := filepath.Join(o.home, "toml", "*.toml")
+// filters are the running filters of the toml directory
+type filters struct {
+	srv  *Server
+	bus  *mbus.Bus
+	d    *filter.Dispatcher
+	glob string
+	f    map[string]*filter.Filter
+	sum  map[string][sha256.Size]byte
+	// journalctl matches, the cursor name
+	match   string
+	journal *gogroup.Group
+	// sources other than the journal by spec
+	source map[string]*gogroup.Group
+	loaded bool
+}
+
+// Toml_dir returns the directory of the toml filters: -toml or <home>/toml
+func Toml_dir(home string) string {
 	if 0 < len(*toml_dir) {
-		td = filepath.Join(*toml_dir, "*.toml")
+		return *toml_dir
 	}
+	return filepath.Join(home, "toml")
+}
+
+// toml_glob returns the glob of the toml filters
+func (o *Server) toml_glob() string {
+	return filepath.Join(Toml_dir(o.home), "*.toml")
+}
+
+func (o *Server) new_filters(bus *mbus.Bus) *filters {
+	td := o.toml_glob()
 	j.Info("toml:", td)
-	toml, err := filepath.Glob(td)
+	return &filters{
+		srv:    o,
+		bus:    bus,
+		d:      filter.New_dispatcher(o.gg, bus),
+		glob:   td,
+		f:      map[string]*filter.Filter{},
+		sum:    map[string][sha256.Size]byte{},
+		source: map[string]*gogroup.Group{},
+	}
+}
+
+// load starts new and changed filters and stops removed ones. A filter that
+// fails keeps its previous version. A change to filter.Vars_file reloads all
+// filters. journalctl is restarted when the journal matches change.
+func (o *filters) load(since string) {
+	toml, err := filepath.Glob(o.glob)
 	if err != nil {
 		j.Err(err)
 		return
 	}
-	enabled := false
-	tag := map[string]bool{}
+	all := false
+	vars := filepath.Join(filepath.Dir(o.glob), filter.Vars_file)
+	if sum, err := file_sum(vars); err == nil || os.IsNotExist(err) {
+		all = sum != o.sum[vars]
+		o.sum[vars] = sum
+	}
+	seen := map[string]bool{}
 	for _, p := range toml {
-		f, err := filter.New(o.gg, bus, p, o.wb, o.rbls)
+		if p == vars {
+			continue
+		}
+		seen[p] = true
+		sum, err := file_sum(p)
 		if err != nil {
 			j.Err(err)
-			return
+			continue
+		}
+		// sum is kept for loaded filters, disabled too
+		if prev, ok := o.sum[p]; ok && !all && sum == prev {
+			continue
+		}
+		f, err := filter.New(o.srv.gg, o.bus, p, o.srv.wb, o.srv.rbls, filter.Dispatch(o.d))
+		if err != nil {
+			if _, ok := o.f[p]; ok {
+				j.Warning("keeping previous filter:", p)
+			}
+			continue
+		}
+		o.sum[p] = sum
+		old, ok := o.f[p]
+		if ok {
+			old.Stop()
 		}
 		if !f.Enabled {
 			f.Stop()
+			if ok {
+				delete(o.f, p)
+				j.Info("filter disabled:", p)
+			}
+			continue
+		}
+		if ok {
+			j.Info("filter reloaded:", p)
+		}
+		o.f[p] = f
+	}
+	for p, f := range o.f {
+		if !seen[p] {
+			f.Stop()
+			delete(o.f, p)
+			j.Info("filter removed:", p)
+		}
+	}
+	for p := range o.sum {
+		if p != vars && !seen[p] {
+			delete(o.sum, p)
+		}
+	}
+	// journalctl matches of a filter are a group, groups are or'ed with +
+	group := map[string]bool{}
+	src := map[string]bool{}
+	for _, f := range o.f {
+		if f.Source != source.Journal {
+			src[f.Source] = true
 			continue
 		}
-		enabled = true
-		for _, t := range f.Tag {
-			tag[t] = true
+		group[strings.Join(f.Journal_match(), ` `)] = true
+	}
+	for spec := range src {
+		if _, ok := o.source[spec]; !ok {
+			o.start_source(spec)
 		}
 	}
-	a := make([]string, 0, len(tag))
-	for s := range tag {
+	for spec, gg := range o.source {
+		if !src[spec] {
+			gg.Cancel()
+			delete(o.source, spec)
+			j.Info("source stopped:", spec)
+		}
+	}
+	a := make([]string, 0, len(group))
+	for s := range group {
 		a = append(a, s)
 	}
-	if !enabled {
+	sort.Strings(a)
+	// A filter without matches reads the whole journal
+	match := []string{}
+	if !group[``] {
+		for i, s := range a {
+			if 0 < i {
+				match = append(match, `+`)
+			}
+			match = append(match, strings.Fields(s)...)
+		}
+	}
+	if len(o.f) == 0 {
 		j.Warning("No filters are enabled")
 		j.Warning("No action will occur")
 		j.Warning(`Filters with "enabled = true" must be available`)
 		j.Warning("Execute: mkdir <directory>")
 		j.Warning("Copy & edit your favorite *.toml to your <directroy>")
-		j.Warning("Execute: systemctl restart banip")
+		j.Warning("Filters are loaded on change or: systemctl reload banip")
 		j.Warning("Typical of a new installation 😊")
 	}
-	Journal(o.gg, bus, false, a, since)
+	defer func() {
+		o.loaded = true
+	}()
+	if len(group) == 0 {
+		if o.journal != nil {
+			o.journal.Cancel()
+			o.journal = nil
+			j.Info("journalctl stopped: no journal filters")
+		}
+		return
+	}
+	if s := strings.Join(match, ` `); o.journal == nil || s != o.match {
+		// -since overrides the saved cursor
+		cursor := ``
+		if len(since) == 0 {
+			cursor = o.srv.cursor(s)
+		}
+		if o.journal != nil {
+			o.journal.Cancel()
+			j.Info("journalctl restart:", s)
+		}
+		if o.loaded && len(cursor) == 0 {
+			since = time.Now().Format("2006-01-02 15:04:05")
+		}
+		o.match = s
+		o.journal = gogroup.New(gogroup.With_cancel(o.srv.gg))
+		Journal(o.journal, o.bus, false, match, since, cursor, func(c string) {
+			o.srv.save_cursor(s, c)
+		})
+	}
+}
+
+// start_source publishes the lines of a source other than the journal to
+// filter.T_source + spec. A source that fails to open is tried on the next
+// load.
+func (o *filters) start_source(spec string) {
+	s, err := open_source(spec)
+	if err != nil {
+		j.Err(err)
+		return
+	}
+	gg := gogroup.New(gogroup.With_cancel(o.srv.gg))
+	o.source[spec] = gg
+	topic := filter.T_source + spec
+	j.Info("source:", spec)
+	go func() {
+		key := gg.Register()
+		defer gg.Unregister(key)
+		if err := s.Run(gg, func(msg string, fields map[string]string) {
+			o.bus.Pub(topic, &filter.Line{Msg: msg, Fields: fields})
+		}); err != nil {
+			j.Err("source:", spec, err)
+		}
+	}()
+}
+
+// Test_source publishes the lines of spec to filter.T_test for -test. A file
+// is read from the start to its end.
+func Test_source(gg *gogroup.Group, bus *mbus.Bus, spec string) {
+	defer bus.Pub(filter.T_test, nil)
+	h := func(msg string, fields map[string]string) {
+		bus.Pub(filter.T_test, &filter.Line{Msg: msg, Fields: fields})
+	}
+	if kind, arg, _ := source.Parse(spec); kind == source.File {
+		f, err := os.Open(arg)
+		if err != nil {
+			j.Err(err)
+			return
+		}
+		defer f.Close()
+		if err = stdin.From(f).Run(gg, h); err != nil {
+			j.Err(err)
+		}
+		return
+	}
+	s, err := open_source(spec)
+	if err != nil {
+		j.Err(err)
+		return
+	}
+	if err = s.Run(gg, h); err != nil {
+		j.Err(err)
+	}
+}
+
+func open_source(spec string) (source.Source, error) {
+	kind, arg, err := source.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	switch kind {
+	case source.File:
+		return tail.New(arg), nil
+	case source.Syslog:
+		i := strings.IndexByte(arg, ':')
+		return syslog.New(arg[:i], arg[i+1:]), nil
+	case source.Stdin:
+		return stdin.New(), nil
+	}
+	return nil, fmt.Errorf("not a source: %v", spec)
+}
+
+// cursor returns the saved journal cursor of the filter set name
+func (o *Server) cursor(name string) (cursor string) {
+	if o.db == nil {
+		return
+	}
+	err := o.db.QueryRowContext(o.gg, "select cursor from journal_cursor where name = :name", sql.Named("name", name)).Scan(&cursor)
+	if err != nil && err != sql.ErrNoRows {
+		j.Err(err)
+	}
+	return
+}
+
+// save_cursor runs after o.gg is done
+func (o *Server) save_cursor(name, cursor string) {
+	if o.db == nil || len(cursor) == 0 {
+		return
+	}
+	if _, err := o.db.ExecContext(context.Background(), `insert into journal_cursor(name, cursor, ts) values(:name, :cursor, :ts)
+	on conflict(name) do update set cursor = excluded.cursor, ts = excluded.ts`,
+		sql.Named("name", name),
+		sql.Named("cursor", cursor),
+		sql.Named("ts", time.Now().Format(tsfmt)),
+	); err != nil {
+		j.Err(err)
+	}
+}
+
+func file_sum(fn string) (sum [sha256.Size]byte, err error) {
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		return
+	}
+	return sha256.Sum256(b), nil
+}
+
+// watch sends to c when a file in dir is written, moved or removed
+func watch(gg *gogroup.Group, dir string, c chan<- struct{}) error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	if _, err = unix.InotifyAddWatch(fd, dir, unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO|unix.IN_MOVED_FROM|unix.IN_DELETE); err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("%v: %v", dir, err)
+	}
+	// A non-blocking fd uses the poller, Close ends Read
+	f := os.NewFile(uintptr(fd), `inotify`)
+	go func() {
+		key := gg.Register()
+		defer gg.Unregister(key)
+		<-gg.Done()
+		f.Close()
+	}()
+	go func() {
+		b := make([]byte, unix.SizeofInotifyEvent*64+unix.PathMax)
+		for {
+			if _, err := f.Read(b); err != nil {
+				return
+			}
+			select {
+			case c <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return nil
 }
 
 func get_database(gg *gogroup.Group, home string) *sql.DB {
@@ -706,6 +1742,14 @@ func get_database(gg *gogroup.Group, home string) *sql.DB {
 			return nil
 		}
 	}
+	if err = migrate(gg, db); err != nil {
+		j.Err(err)
+		return nil
+	}
+	if _, err = db.ExecContext(gg, cursor_schema); err != nil {
+		j.Err(err)
+		return nil
+	}
 	return db
 }
 
@@ -717,29 +1761,95 @@ create table if not exists ip (
   , toml text
   , rbl text
   , log text
+  , ct int not null default 1
+  , exp datetime
+  , fields text
 );
 -- vim: ts=2 expandtab`
 
-type m struct {
-	Tag     string      `json:"SYSLOG_IDENTIFIER"`
-	Message interface{} `json:"MESSAGE"`
+// The last journal cursor of a filter set, name: syslog identifiers
+var cursor_schema = `create table if not exists journal_cursor (
+    name text not null primary key
+  , cursor text not null
+  , ts datetime not null
+);`
+
+// Columns added to ip after the original schema. fill is run once after
+// the column is added.
+func ip_columns() []struct{ name, def, fill string } {
+	return []struct{ name, def, fill string }{
+		{`ct`, `int not null default 1`, ``},
+		// exp null is permanent. Existing bans expire after -bdur.
+		{`exp`, `datetime`, fmt.Sprintf(`update ip set exp = strftime('%%Y-%%m-%%d %%H:%%M:%%S+00:00', ts, '+%d seconds') where ban = 1`, int64(ban_dur.Seconds()))},
+		// JSON of the filter named groups
+		{`fields`, `text`, ``},
+	}
+}
+
+func migrate(gg *gogroup.Group, db *sql.DB) error {
+	rows, err := db.QueryContext(gg, "select name from pragma_table_info('ip')")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	have := map[string]bool{}
+	var name string
+	for rows.Next() {
+		if err = rows.Scan(&name); err != nil {
+			return err
+		}
+		have[name] = true
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for _, c := range ip_columns() {
+		if have[c.name] {
+			continue
+		}
+		j.Info("adding column: ip.", c.name)
+		if _, err = db.ExecContext(gg, "alter table ip add column "+c.name+" "+c.def); err != nil {
+			return err
+		}
+		if 0 < len(c.fill) {
+			if _, err = db.ExecContext(gg, c.fill); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
-func Journal(gg *gogroup.Group, bus *mbus.Bus, test bool, tag []string, since string) {
-	tag_args := make([]string, 0, (len(tag)*2)+6)
-	if 0 < len(since) {
+// Journal publishes a *filter.Line for each entry of the journalctl matches
+// to its SYSLOG_IDENTIFIER and filter.T_any. cursor: resume after the journal
+// cursor, since is not used. save is called with the __CURSOR of the last
+// entry every cursor_save and at the end, nil: none. Without test the
+// goroutines are registered with gg: gg.Wait returns after the last save.
+func Journal(gg *gogroup.Group, bus *mbus.Bus, test bool, match []string, since, cursor string, save func(string)) {
+	args := make([]string, 0, len(match)+10)
+	switch {
+	case 0 < len(cursor):
+		j.Info("cursor:", cursor)
+		args = append(args, "--after-cursor", cursor)
+	case 0 < len(since):
 		j.Info("since:", since)
-		tag_args = append(tag_args, "--since", since)
+		args = append(args, "--since", since)
 	}
-	if test {
-		tag_args = append(tag_args, "--output", "json")
-	} else {
-		tag_args = append(tag_args, "-n", "all", "-f", "--output", "json")
+	if !test {
+		args = append(args, "-n", "all", "-f")
 	}
-	for _, t := range tag {
-		tag_args = append(tag_args, "-t", t)
+	// SYSLOG_PID: correlate key
+	fields := []string{`MESSAGE`, `SYSLOG_IDENTIFIER`, `SYSLOG_PID`}
+	seen := map[string]bool{`MESSAGE`: true, `SYSLOG_IDENTIFIER`: true, `SYSLOG_PID`: true}
+	for _, m := range match {
+		if i := strings.IndexByte(m, '='); 0 < i && !seen[m[:i]] {
+			seen[m[:i]] = true
+			fields = append(fields, m[:i])
+		}
 	}
-	cmd := exec.CommandContext(gg, "journalctl", tag_args...)
+	args = append(args, "--no-pager", "--output", "export", "--output-fields", strings.Join(fields, `,`))
+	args = append(args, match...)
+	cmd := exec.CommandContext(gg, "journalctl", args...)
 	var e bytes.Buffer
 	rp, wp := io.Pipe()
 	cmd.Stdout = wp
@@ -753,38 +1863,75 @@ func Journal(gg *gogroup.Group, bus *mbus.Bus, test bool, tag []string, since st
 			defer func() {
 				bus.Pub(filter.T_test, nil)
 			}()
+		} else {
+			key := gg.Register()
+			defer gg.Unregister(key)
 		}
 		defer rp.Close()
-		scanner := bufio.NewScanner(rp)
-		for scanner.Scan() {
-			var m m
-			if err := json.NewDecoder(bytes.NewReader(scanner.Bytes())).Decode(&m); err != nil {
-				j.Err(err, scanner.Text())
-				continue
-			}
-			var s string
-			switch t := m.Message.(type) {
-			case string:
-				s = t
-			case []byte:
-				s = string(t)
-			}
-			if test {
-				bus.Pub(filter.T_test, s)
-			} else {
-				bus.Pub(m.Tag, s)
-			}
+		c, jerr := jep.New(gg, rp)
+		var last, saved string
+		tick := time.NewTicker(cursor_save)
+		defer tick.Stop()
+		if save != nil {
+			defer func() {
+				if last != saved {
+					save(last)
+				}
+			}()
 		}
-		if err := scanner.Err(); err != nil {
-			j.Err(err)
+		for {
+			select {
+			case <-tick.C:
+				if save != nil && last != saved {
+					save(last)
+					saved = last
+				}
+			case en, ok := <-c:
+				if !ok {
+					if err := jerr.Error(); err != nil {
+						j.Err(err)
+					}
+					return
+				}
+				last = en[`__CURSOR`]
+				l := &filter.Line{Msg: en[`MESSAGE`], Fields: en}
+				if test {
+					bus.Pub(filter.T_test, l)
+				} else {
+					bus.Pub(en[`SYSLOG_IDENTIFIER`], l)
+					bus.Pub(filter.T_any, l)
+				}
+			}
 		}
 	}()
 	go func() {
+		if !test {
+			key := gg.Register()
+			defer gg.Unregister(key)
+		}
 		defer wp.Close()
-		cmd.Wait()
+		if err := cmd.Wait(); err != nil && gg.Err() == nil {
+			j.Err("journalctl:", err, strings.TrimSpace(e.String()))
+		}
 	}()
 }
 
+// Journal_identifiers returns the SYSLOG_IDENTIFIER values of the journal
+func Journal_identifiers() (map[string]bool, error) {
+	cmd := exec.Command(`journalctl`, `--no-pager`, `-F`, `SYSLOG_IDENTIFIER`)
+	b, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", cmd.Args, err)
+	}
+	r := map[string]bool{}
+	for _, s := range strings.Split(string(b), "\n") {
+		if s = strings.TrimSpace(s); 0 < len(s) {
+			r[s] = true
+		}
+	}
+	return r, nil
+}
+
 func Load_fail2ban(gg *gogroup.Group, f2bdb, home string) {
 	defer gg.Cancel()
 	if _, err := os.Stat(f2bdb); err != nil {
@@ -816,7 +1963,7 @@ func Load_fail2ban(gg *gogroup.Group, f2bdb, home string) {
 		j.Err(err)
 		return
 	}
-	insert, err := db.PrepareContext(gg, "insert or ignore into ip(ip, ban, ts, toml) values(:ip, 1, :ts, :toml)")
+	insert, err := db.PrepareContext(gg, "insert or ignore into ip(ip, ban, ts, toml, exp) values(:ip, 1, :ts, :toml, :exp)")
 	if err != nil {
 		j.Err(err)
 	}
@@ -826,7 +1973,18 @@ func Load_fail2ban(gg *gogroup.Group, f2bdb, home string) {
 			j.Err(err)
 			return
 		}
-		_, err := tx.StmtContext(gg, insert).ExecContext(gg, sql.Named("ip", ip), sql.Named("ts", ts.UTC().Format(tsfmt)), sql.Named("toml", "f2b"+jail))
+		i, err := list.Valid_ip_cidr(ip)
+		if err != nil {
+			j.Warning(err)
+			continue
+		}
+		switch t := i.(type) {
+		case *net.IP:
+			ip = t.String()
+		case *net.IPNet:
+			ip = t.String()
+		}
+		_, err = tx.StmtContext(gg, insert).ExecContext(gg, sql.Named("ip", ip), sql.Named("ts", ts.UTC().Format(tsfmt)), sql.Named("toml", "f2b"+jail), sql.Named("exp", ts.Add(*ban_dur).UTC().Format(tsfmt)))
 		if err != nil {
 			j.Err(err)
 			return
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aletheia7/banip/fw"
+	"github.com/aletheia7/banip/list"
+	"github.com/aletheia7/gogroup"
+)
+
+// fake_fw rejects overlapping elements like an nft interval set
+type fake_fw struct {
+	mu sync.Mutex
+	m  map[string]fw.Element
+}
+
+func (o *fake_fw) Add(e ...fw.Element) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, el := range e {
+		for ip := range o.m {
+			if ip != el.Ip && (contains(ip, el.Ip) || contains(el.Ip, ip)) {
+				return fmt.Errorf("overlap: %v %v", ip, el.Ip)
+			}
+		}
+		o.m[el.Ip] = el
+	}
+	return nil
+}
+
+func (o *fake_fw) Remove(ip ...string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, s := range ip {
+		delete(o.m, s)
+	}
+	return nil
+}
+
+func (o *fake_fw) Flush() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.m = map[string]fw.Element{}
+	return nil
+}
+
+func (o *fake_fw) List() (a []fw.Element, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, el := range o.m {
+		a = append(a, el)
+	}
+	return
+}
+
+func (o *fake_fw) ips() string {
+	a, _ := o.List()
+	s := make([]string, 0, len(a))
+	for _, el := range a {
+		s = append(s, el.Ip)
+	}
+	sort.Strings(s)
+	return strings.Join(s, ` `)
+}
+
+// contains is true when network a contains ip or network b
+func contains(a, b string) bool {
+	_, n, err := net.ParseCIDR(a)
+	if err != nil {
+		return false
+	}
+	if ip, _, err := net.ParseCIDR(b); err == nil {
+		return n.Contains(ip)
+	}
+	return n.Contains(net.ParseIP(b))
+}
+
+func new_server(t *testing.T) (*Server, *fake_fw) {
+	gg := gogroup.New()
+	t.Cleanup(func() {
+		gg.Cancel()
+		gg.Wait()
+	})
+	home := t.TempDir()
+	if err := os.Mkdir(filepath.Join(home, `db`), 0700); err != nil {
+		t.Fatal(err)
+	}
+	o := New(gg, home, nil)
+	if o.db == nil {
+		t.Fatal("no database")
+	}
+	t.Cleanup(func() { o.db.Close() })
+	f := &fake_fw{m: map[string]fw.Element{}}
+	o.fw = f
+	return o, f
+}
+
+func Test_bl_network(t *testing.T) {
+	o, f := new_server(t)
+	now := time.Now()
+	for _, ip := range []string{`192.0.2.1`, `192.0.2.64/26`, `198.51.100.1`} {
+		if id := o.Bl(ip, `test`, nil, nil, nil, now, time.Hour); id <= 0 {
+			t.Fatal("Bl:", ip, id)
+		}
+	}
+	if id := o.Bl(`192.0.2.0/24`, `test`, nil, nil, nil, now, time.Hour); id <= 0 {
+		t.Fatal("Bl network:", id)
+	}
+	a := o.wb.B.All()
+	sort.Strings(a)
+	if s := strings.Join(a, ` `); s != `192.0.2.0/24 198.51.100.1` {
+		t.Error("blacklist:", s)
+	}
+	if s := f.ips(); s != `192.0.2.0/24 198.51.100.1` {
+		t.Error("firewall:", s)
+	}
+	var ct int
+	if err := o.db.QueryRow("select count(*) from ip where ip in ('192.0.2.1', '192.0.2.64/26')").Scan(&ct); err != nil {
+		t.Fatal(err)
+	}
+	if ct != 0 {
+		t.Error("absorbed rows:", ct)
+	}
+	// Inside the network
+	if id := o.Bl(`192.0.2.9`, `test`, nil, nil, nil, now, time.Hour); id != -1 {
+		t.Error("Bl inside network:", id)
+	}
+	if err := o.db.QueryRow("select count(*) from ip where ip = :ip", sql.Named("ip", `192.0.2.0/24`)).Scan(&ct); err != nil || ct != 1 {
+		t.Error("network row:", ct, err)
+	}
+}
+
+// An older database has IPs inside banned networks
+func Test_reconcile_overlap(t *testing.T) {
+	o, f := new_server(t)
+	now := time.Now()
+	for _, ip := range []string{`192.0.2.1`, `192.0.2.0/24`, `198.51.100.1`} {
+		o.wb.B.Add(ip, list.Entry{Ts: now, Ct: 1})
+	}
+	f.Add(fw.Element{Ip: `192.0.2.1`})
+	if err := o.Reconcile(``); err != nil {
+		t.Fatal(err)
+	}
+	if s := f.ips(); s != `192.0.2.0/24 198.51.100.1` {
+		t.Error("firewall:", s)
+	}
+}
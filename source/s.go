@@ -0,0 +1,71 @@
+// Copyright 2018 aletheia7. All rights reserved. Use of this source code is
+// governed by a BSD-2-Clause license that can be found in the LICENSE file.
+
+// Package source is the log source interface of filters other than the
+// journal. Sources: tail.File (follows a file), syslog.Listener (RFC5424,
+// RFC3164) and stdin.Reader.
+//
+// A filter chooses a source with a spec:
+//
+//	journal                       default
+//	file:/var/log/nginx/error.log
+//	syslog:udp:127.0.0.1:5514
+//	syslog:unixgram:/run/banip/log
+//	stdin
+package source
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aletheia7/gogroup"
+)
+
+// Source kinds
+const (
+	Journal = `journal`
+	File    = `file`
+	Syslog  = `syslog`
+	Stdin   = `stdin`
+)
+
+// Handler receives a line. fields use journal field names, i.e.
+// SYSLOG_IDENTIFIER, PRIORITY. fields may be nil.
+type Handler func(msg string, fields map[string]string)
+
+type Source interface {
+	// Run calls h for each line until gg is done or the input ends
+	Run(gg *gogroup.Group, h Handler) error
+}
+
+// Parse returns the kind and the argument of a spec. syslog arg:
+// <network>:<address>
+func Parse(spec string) (kind, arg string, err error) {
+	kind = spec
+	if i := strings.IndexByte(spec, ':'); 0 <= i {
+		kind, arg = spec[:i], spec[i+1:]
+	}
+	switch kind {
+	case Journal, Stdin:
+		if 0 < len(arg) {
+			return ``, ``, fmt.Errorf("source: %v takes no argument: %v", kind, spec)
+		}
+	case File:
+		if len(arg) == 0 {
+			return ``, ``, fmt.Errorf("source: missing path: %v", spec)
+		}
+	case Syslog:
+		i := strings.IndexByte(arg, ':')
+		if i < 0 || len(arg) <= i+1 {
+			return ``, ``, fmt.Errorf("source: use syslog:<udp|unixgram>:<address>: %v", spec)
+		}
+		switch arg[:i] {
+		case `udp`, `udp4`, `udp6`, `unixgram`:
+		default:
+			return ``, ``, fmt.Errorf("source: unknown syslog network: %v", spec)
+		}
+	default:
+		return ``, ``, fmt.Errorf("source: unknown: %v, use: journal, file, syslog, stdin", spec)
+	}
+	return
+}
@@ -0,0 +1,43 @@
+// Copyright 2018 aletheia7. All rights reserved. Use of this source code is
+// governed by a BSD-2-Clause license that can be found in the LICENSE file.
+
+// Package stdin reads log lines from standard input, i.e.
+// tail -F app.log | banip -fw nft
+package stdin
+
+import (
+	"bufio"
+	"io"
+	"os"
+
+	"github.com/aletheia7/banip/source"
+	"github.com/aletheia7/gogroup"
+)
+
+var _ source.Source = &Reader{}
+
+type Reader struct {
+	r io.Reader
+}
+
+func New() *Reader {
+	return &Reader{r: os.Stdin}
+}
+
+// From reads r instead of standard input
+func From(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// Run returns at EOF. A line in progress is read before gg done is seen.
+func (o *Reader) Run(gg *gogroup.Group, h source.Handler) error {
+	sc := bufio.NewScanner(o.r)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	for sc.Scan() {
+		if gg.Err() != nil {
+			return nil
+		}
+		h(sc.Text(), nil)
+	}
+	return sc.Err()
+}
@@ -0,0 +1,180 @@
+// Copyright 2018 aletheia7. All rights reserved. Use of this source code is
+// governed by a BSD-2-Clause license that can be found in the LICENSE file.
+
+// Package syslog is a local syslog listener for udp and unixgram sockets.
+// Messages are RFC5424 or RFC3164, with or without a hostname.
+package syslog
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aletheia7/banip/source"
+	"github.com/aletheia7/gogroup"
+)
+
+var _ source.Source = &Listener{}
+
+type Listener struct {
+	// udp, udp4, udp6 or unixgram
+	Network string
+	Address string
+	// unixgram socket mode
+	Mode os.FileMode
+}
+
+type option func(*Listener)
+
+// Mode of the unixgram socket. Default: 0660
+func Mode(m os.FileMode) option {
+	return func(o *Listener) {
+		o.Mode = m
+	}
+}
+
+func New(network, address string, opt ...option) *Listener {
+	o := &Listener{Network: network, Address: address, Mode: 0660}
+	for _, op := range opt {
+		op(o)
+	}
+	return o
+}
+
+// Run receives messages until gg is done. A unixgram socket is replaced and
+// removed at the end.
+func (o *Listener) Run(gg *gogroup.Group, h source.Handler) error {
+	if o.Network == `unixgram` {
+		if err := os.Remove(o.Address); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		defer os.Remove(o.Address)
+	}
+	pc, err := net.ListenPacket(o.Network, o.Address)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+	if o.Network == `unixgram` {
+		if err = os.Chmod(o.Address, o.Mode); err != nil {
+			return err
+		}
+	}
+	go func() {
+		key := gg.Register()
+		defer gg.Unregister(key)
+		<-gg.Done()
+		pc.Close()
+	}()
+	b := make([]byte, 64*1024)
+	for {
+		n, _, err := pc.ReadFrom(b)
+		if err != nil {
+			if gg.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		h(Parse(b[:n]))
+	}
+}
+
+// Parse returns the message and the journal fields of a syslog message:
+// PRIORITY, SYSLOG_FACILITY, SYSLOG_IDENTIFIER, SYSLOG_PID,
+// SYSLOG_TIMESTAMP and _HOSTNAME. A message without <PRI> is returned as is.
+func Parse(b []byte) (msg string, fields map[string]string) {
+	s := string(bytes.TrimRight(b, "\r\n\x00"))
+	if len(s) < 3 || s[0] != '<' {
+		return s, nil
+	}
+	end := strings.IndexByte(s, '>')
+	if end < 2 || 4 < end {
+		return s, nil
+	}
+	pri, err := strconv.Atoi(s[1:end])
+	if err != nil || 191 < pri {
+		return s, nil
+	}
+	fields = map[string]string{
+		`PRIORITY`:        strconv.Itoa(pri % 8),
+		`SYSLOG_FACILITY`: strconv.Itoa(pri / 8),
+	}
+	s = s[end+1:]
+	if strings.HasPrefix(s, `1 `) {
+		return rfc5424(s[2:], fields), fields
+	}
+	return rfc3164(s, fields), fields
+}
+
+// TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+func rfc5424(s string, fields map[string]string) string {
+	for _, k := range []string{`SYSLOG_TIMESTAMP`, `_HOSTNAME`, `SYSLOG_IDENTIFIER`, `SYSLOG_PID`, ``} {
+		i := strings.IndexByte(s, ' ')
+		if i < 0 {
+			return ``
+		}
+		if v := s[:i]; 0 < len(k) && v != `-` {
+			fields[k] = v
+		}
+		s = s[i+1:]
+	}
+	// STRUCTURED-DATA: - or [id param="value"]...
+	if strings.HasPrefix(s, `-`) {
+		s = s[1:]
+	} else {
+		for strings.HasPrefix(s, `[`) {
+			i := 1
+			for quoted := false; i < len(s); i++ {
+				if s[i] == '\\' {
+					i++
+				} else if s[i] == '"' {
+					quoted = !quoted
+				} else if s[i] == ']' && !quoted {
+					break
+				}
+			}
+			if len(s) <= i {
+				return ``
+			}
+			s = s[i+1:]
+		}
+	}
+	s = strings.TrimPrefix(s, ` `)
+	return strings.TrimPrefix(s, "\xef\xbb\xbf")
+}
+
+// [Mmm dd hh:mm:ss] [HOSTNAME] TAG[PID]: MSG
+func rfc3164(s string, fields map[string]string) string {
+	if len(time.Stamp) < len(s) && s[len(time.Stamp)] == ' ' {
+		if _, err := time.Parse(time.Stamp, s[:len(time.Stamp)]); err == nil {
+			fields[`SYSLOG_TIMESTAMP`] = s[:len(time.Stamp)]
+			s = s[len(time.Stamp)+1:]
+		}
+	}
+	// A hostname is a word followed by the tag
+	if i := strings.IndexByte(s, ' '); 0 < i && !strings.ContainsAny(s[:i], `[:`) {
+		if j := strings.IndexAny(s[i+1:], `[: `); 0 < j && s[i+1+j] != ' ' {
+			fields[`_HOSTNAME`] = s[:i]
+			s = s[i+1:]
+		}
+	}
+	i := strings.IndexAny(s, `[: `)
+	if i <= 0 || s[i] == ' ' {
+		return s
+	}
+	fields[`SYSLOG_IDENTIFIER`] = s[:i]
+	s = s[i:]
+	if s[0] == '[' {
+		end := strings.IndexByte(s, ']')
+		if end < 0 {
+			return s
+		}
+		fields[`SYSLOG_PID`] = s[1:end]
+		s = s[end+1:]
+	}
+	s = strings.TrimPrefix(s, `:`)
+	return strings.TrimPrefix(s, ` `)
+}
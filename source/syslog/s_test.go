@@ -0,0 +1,22 @@
+package syslog
+
+import "testing"
+
+func Test_parse(t *testing.T) {
+	for _, tc := range []struct {
+		in, msg, tag, host, pid, pri string
+	}{
+		{`<34>1 2003-10-11T22:14:15.003Z mymachine.example.com su - ID47 - 'su root' failed for lonvick on /dev/pts/8`, `'su root' failed for lonvick on /dev/pts/8`, `su`, `mymachine.example.com`, ``, `2`},
+		{`<165>1 2003-10-11T22:14:15.003Z host app 1234 ID47 [exampleSDID@32473 iut="3" eventSource="Appl\]ication"] ` + "\xef\xbb\xbf" + `An application event`, `An application event`, `app`, `host`, `1234`, `5`},
+		{`<13>1 - - - - - -`, ``, ``, ``, ``, `5`},
+		{`<34>Oct 11 22:14:15 mymachine su: 'su root' failed`, `'su root' failed`, `su`, `mymachine`, ``, `2`},
+		{`<38>Oct  1 02:04:05 sshd[123]: Failed password for root from 192.0.2.1 port 22 ssh2`, `Failed password for root from 192.0.2.1 port 22 ssh2`, `sshd`, ``, `123`, `6`},
+		{`<38>nginx: connect() failed` + "\n", `connect() failed`, `nginx`, ``, ``, `6`},
+		{`no pri`, `no pri`, ``, ``, ``, ``},
+	} {
+		msg, f := Parse([]byte(tc.in))
+		if msg != tc.msg || f[`SYSLOG_IDENTIFIER`] != tc.tag || f[`_HOSTNAME`] != tc.host || f[`SYSLOG_PID`] != tc.pid || f[`PRIORITY`] != tc.pri {
+			t.Errorf("%v\n%q %v", tc.in, msg, f)
+		}
+	}
+}
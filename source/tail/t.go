@@ -0,0 +1,148 @@
+// Copyright 2018 aletheia7. All rights reserved. Use of this source code is
+// governed by a BSD-2-Clause license that can be found in the LICENSE file.
+
+// Package tail follows a log file across rotation: rename (logrotate create)
+// and copytruncate.
+package tail
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"time"
+
+	"github.com/aletheia7/banip/source"
+	"github.com/aletheia7/gogroup"
+)
+
+// Max_line is the longest line, longer lines are split
+const Max_line = 1 << 20
+
+var _ source.Source = &File{}
+
+type File struct {
+	Path string
+	Poll time.Duration
+}
+
+type option func(*File)
+
+// Poll interval for new lines and rotation. Default: 1s
+func Poll(d time.Duration) option {
+	return func(o *File) {
+		o.Poll = d
+	}
+}
+
+func New(path string, opt ...option) *File {
+	o := &File{Path: path, Poll: time.Second}
+	for _, op := range opt {
+		op(o)
+	}
+	return o
+}
+
+// Run follows Path from its end. A missing file is waited for. After a
+// rename the old file is read to its end and the new file is read from the
+// start. A truncated file is read from the start, unless it has grown past
+// the read position within Poll.
+func (o *File) Run(gg *gogroup.Group, h source.Handler) error {
+	var partial []byte
+	f, err := os.Open(o.Path)
+	switch {
+	case err == nil:
+		if _, err = f.Seek(0, io.SeekEnd); err != nil {
+			f.Close()
+			return err
+		}
+	case os.IsNotExist(err):
+		f = nil
+	default:
+		return err
+	}
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+	tick := time.NewTicker(o.Poll)
+	defer tick.Stop()
+	b := make([]byte, 64*1024)
+	read := func() error {
+		for {
+			n, err := f.Read(b)
+			if 0 < n {
+				partial = lines(append(partial, b[:n]...), h)
+			}
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for {
+		if f != nil {
+			if err := read(); err != nil {
+				return err
+			}
+		}
+		select {
+		case <-gg.Done():
+			return nil
+		case <-tick.C:
+		}
+		fi, err := os.Stat(o.Path)
+		if err != nil {
+			// rotated away, the new file is not there yet
+			continue
+		}
+		if f != nil {
+			cur, err := f.Stat()
+			if err != nil {
+				return err
+			}
+			if os.SameFile(fi, cur) {
+				if pos, err := f.Seek(0, io.SeekCurrent); err == nil && fi.Size() < pos {
+					// copytruncate
+					partial = partial[:0]
+					if _, err = f.Seek(0, io.SeekStart); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			// renamed: read the rest of the old file
+			if err := read(); err != nil {
+				return err
+			}
+			if 0 < len(partial) {
+				h(string(partial), nil)
+				partial = partial[:0]
+			}
+			f.Close()
+		}
+		if f, err = os.Open(o.Path); err != nil {
+			f = nil
+		}
+	}
+}
+
+// lines calls h for each complete line of b and returns the rest
+func lines(b []byte, h source.Handler) []byte {
+	for {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			break
+		}
+		h(string(bytes.TrimSuffix(b[:i], []byte{'\r'})), nil)
+		b = b[i+1:]
+	}
+	if Max_line < len(b) {
+		h(string(b), nil)
+		b = b[:0]
+	}
+	// Keep the rest at the start of a new slice, b is reused by append
+	return append([]byte(nil), b...)
+}
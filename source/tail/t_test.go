@@ -0,0 +1,64 @@
+package tail
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aletheia7/gogroup"
+)
+
+func Test_rotate(t *testing.T) {
+	p := filepath.Join(t.TempDir(), `log`)
+	write := func(flag int, s string) {
+		f, err := os.OpenFile(p, flag|os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(s)
+		f.Close()
+	}
+	write(os.O_TRUNC, "old\n")
+	gg := gogroup.New()
+	defer gg.Cancel()
+	c := make(chan string, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- New(p, Poll(time.Millisecond*10)).Run(gg, func(msg string, fields map[string]string) {
+			c <- msg
+		})
+	}()
+	expect := func(s string) {
+		select {
+		case m := <-c:
+			if m != s {
+				t.Fatalf("line: %q, expected: %q", m, s)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout: %q", s)
+		}
+	}
+	time.Sleep(time.Millisecond * 50)
+	write(os.O_APPEND, "a\nb")
+	expect(`a`)
+	write(os.O_APPEND, "\r\n")
+	expect(`b`)
+	// rename rotation, the last line of the old file is read
+	write(os.O_APPEND, "c\n")
+	if err := os.Rename(p, p+`.1`); err != nil {
+		t.Fatal(err)
+	}
+	write(os.O_TRUNC, "d\n")
+	expect(`c`)
+	expect(`d`)
+	write(os.O_APPEND, "a longer line\n")
+	expect(`a longer line`)
+	// copytruncate
+	write(os.O_TRUNC, "e\n")
+	expect(`e`)
+	gg.Cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
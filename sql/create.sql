@@ -1,20 +1,21 @@
+-- Matches the schema and cursor_schema of server/s.go
 drop table if exists ip;
 create table if not exists ip (
-    ip text not null
+    ip text not null unique
   , ban int not null check(ban in (0, 1))
   , ts datetime not null
   , toml text
   , rbl text
   , log text
+  , ct int not null default 1
+  , exp datetime
+  , fields text
 );
 drop index if exists ip_i;
-create unique index ip_i on ip(ip, ban);
 
-drop table if exists con;
-create table if not exists con (
-    ip text not null 
+create table if not exists journal_cursor (
+    name text not null primary key
+  , cursor text not null
   , ts datetime not null
 );
-drop index if exists con_i;
-create unique index con_i on ip(ip, ts);
 -- vim: ts=2 expandtab
@@ -18,6 +18,8 @@ var (
 	j       = sd.New()
 	max_syn = flag.Int("syn-max", 10, "max syn")
 	syn_in  = flag.String("syn-src", "ss", "input: ss or <file name>")
+	syn_dur = flag.Duration("syn-bdur", 0, "syn mode ban duration, escalated by -bsteps, default: -bdur")
+	syn_ban = flag.Bool("syn-ban", false, "syn mode bans, default: log only")
 )
 
 const expire_sent = time.Hour
@@ -41,7 +43,7 @@ func New(gg *gogroup.Group, srv *server.Server) {
 	}
 	switch {
 	case *syn_in == "ss":
-		r.args = []string{"ss", "-t4naH", "-o", "state", "syn-recv"}
+		r.args = []string{"ss", "-tnaH", "-o", "state", "syn-recv"}
 	default:
 		r.args = []string{"cat", *syn_in}
 	}
@@ -143,13 +145,23 @@ line_loop:
 			j.Err(err)
 			return err
 		}
+		// ss prints IPv6 sources as [2001:db8::1]:port and
+		// IPv4 sources on dual-stack sockets as [::ffff:192.0.2.1]:port
+		remote_ipb := net.ParseIP(remote_ip)
+		if remote_ipb == nil {
+			j.Warning("invalid ip:", remote_ip)
+			continue
+		}
+		if v4 := remote_ipb.To4(); v4 != nil {
+			remote_ipb = v4
+		}
+		remote_ip = remote_ipb.String()
 		for _, a := range o.addr {
 			if remote_ip == a {
 				continue line_loop
 			}
 		}
-		remote_ipb := net.ParseIP(remote_ip)
-		if o.srv.WB().W.Lookup(remote_ipb.To4()) {
+		if o.srv.WB().W.Lookup(remote_ipb) {
 			continue line_loop
 		}
 		st, ok := ip[remote_ip]
@@ -167,9 +179,13 @@ line_loop:
 			}
 			o.sent_to_bl[remote_ip] = time.Now()
 			o.sent_mu.Unlock()
-			// todo uncomment
-			// id := o.srv.Bl(remote_ip, `syn ban`, nil, nil)
-			j.Info("syn ban", remote_ip)
+			if !*syn_ban {
+				j.Info("syn ban", remote_ip)
+				continue
+			}
+			if id := o.srv.Bl(remote_ip, `syn ban`, nil, nil, nil, time.Now(), *syn_dur); 0 < id {
+				j.Info("syn ban", remote_ip)
+			}
 		}
 	}
 	return